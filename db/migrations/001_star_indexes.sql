@@ -0,0 +1,3 @@
+ALTER TABLE star
+    ADD KEY keyword_idx(keyword, id),
+    ADD KEY user_name_idx(user_name, id);
@@ -0,0 +1,5 @@
+-- ISUDA_STAR_POLICY=unique のときだけ unique_star = 1 で入れる。
+-- NULL 同士は一意制約にかからないので、他のポリシーでは重複してスターできる
+ALTER TABLE star
+    ADD COLUMN unique_star TINYINT NULL AFTER user_name,
+    ADD UNIQUE KEY keyword_user_unique(keyword, user_name, unique_star);
@@ -0,0 +1,4 @@
+-- "<アルゴリズム名>$<ハッシュ>" 形式のパスワードが入るように広げる。
+-- 既存の sha1 の hex はそのまま残し、ログイン時に保存し直す
+ALTER TABLE user
+    MODIFY password VARCHAR(255);
@@ -0,0 +1,6 @@
+ALTER TABLE user
+    ADD COLUMN is_admin TINYINT(1) NOT NULL DEFAULT 0;
+
+-- protected なエントリは管理者しか編集・削除できない
+ALTER TABLE entry
+    ADD COLUMN protected TINYINT(1) NOT NULL DEFAULT 0;
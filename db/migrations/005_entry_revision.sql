@@ -0,0 +1,12 @@
+-- エントリの説明文の履歴。投稿のたびに 1 行追加する
+CREATE TABLE entry_revision (
+    id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    keyword VARCHAR(191) NOT NULL,
+    description MEDIUMTEXT,
+    author_id BIGINT UNSIGNED NOT NULL,
+    created_at DATETIME NOT NULL,
+    KEY keyword_idx(keyword, id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+INSERT INTO entry_revision (keyword, description, author_id, created_at)
+    SELECT keyword, description, author_id, updated_at FROM entry ORDER BY id;
@@ -0,0 +1,20 @@
+-- spam と判定された投稿。管理者が承認すると entry に反映する
+CREATE TABLE pending_entry (
+    id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    author_id BIGINT UNSIGNED NOT NULL,
+    keyword VARCHAR(191) NOT NULL,
+    description MEDIUMTEXT,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    reviewer_id BIGINT UNSIGNED NULL,
+    created_at DATETIME NOT NULL,
+    reviewed_at DATETIME NULL,
+    KEY status_idx(status, id),
+    KEY author_idx(author_id, id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+-- 管理者の判断。content の sha256 ごとに spam かどうかを覚えておく
+CREATE TABLE spam_verdict (
+    content_hash CHAR(64) NOT NULL PRIMARY KEY,
+    spam TINYINT(1) NOT NULL,
+    created_at DATETIME NOT NULL
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
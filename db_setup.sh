@@ -12,6 +12,9 @@ mysql -u${myuser} -p${mypass} -e "DROP DATABASE IF EXISTS ${isuda_mydb}; CREATE
 mysql -u${myuser} -p${mypass} ${isuda_mydb} < ./db/isuda.sql
 mysql -u${myuser} -p${mypass} ${isuda_mydb} < ./db/isuda_user.sql
 mysql -u${myuser} -p${mypass} ${isuda_mydb} < ./db/isuda_entry.sql
+for f in ./db/migrations/*.sql; do
+  mysql -u${myuser} -p${mypass} ${isuda_mydb} < ${f}
+done
 
 # Isutar
 # isutar_mydb=isutar
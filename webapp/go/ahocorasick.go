@@ -0,0 +1,161 @@
+package main
+
+// Aho-Corasick オートマトン
+// パターンはバイト列として扱う。UTF-8 のパターンは UTF-8 の本文に対して
+// 文字境界でしかマッチしないので、日本語のキーワードもそのまま扱える。
+
+type acNode struct {
+	fail  int32
+	depth int32
+	// このノードで終わる最長のパターン長 (fail を辿ったものも含む)。0 ならなし
+	out int32
+}
+
+type ahoCorasick struct {
+	nodes []acNode
+	// (ノード番号 << 8 | バイト) -> 遷移先ノード
+	edges map[int64]int32
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{
+		nodes: []acNode{{}},
+		edges: make(map[int64]int32),
+	}
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		var cur int32
+		for i := 0; i < len(p); i++ {
+			key := int64(cur)<<8 | int64(p[i])
+			next, ok := ac.edges[key]
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{depth: ac.nodes[cur].depth + 1})
+				ac.edges[key] = next
+			}
+			cur = next
+		}
+		ac.nodes[cur].out = int32(len(p))
+	}
+	ac.buildFailure()
+	return ac
+}
+
+func (ac *ahoCorasick) buildFailure() {
+	children := make([][]int64, len(ac.nodes))
+	for key := range ac.edges {
+		parent := key >> 8
+		children[parent] = append(children[parent], key)
+	}
+
+	queue := make([]int32, 0, len(ac.nodes))
+	queue = append(queue, 0)
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, key := range children[cur] {
+			child := ac.edges[key]
+			b := byte(key & 0xff)
+			if cur != 0 {
+				ac.nodes[child].fail = ac.next(ac.nodes[cur].fail, b)
+			}
+			if ac.nodes[child].out == 0 {
+				ac.nodes[child].out = ac.nodes[ac.nodes[child].fail].out
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+func (ac *ahoCorasick) next(state int32, b byte) int32 {
+	for {
+		if next, ok := ac.edges[int64(state)<<8|int64(b)]; ok {
+			return next
+		}
+		if state == 0 {
+			return 0
+		}
+		state = ac.nodes[state].fail
+	}
+}
+
+// each は text 中のマッチを leftmost-longest で重ならないように先頭から列挙する。
+// strings.NewReplacer に長い順でパターンを渡したときと同じ選び方になる。
+func (ac *ahoCorasick) each(text string, fn func(start, end int)) {
+	if ac == nil || len(ac.nodes) <= 1 {
+		return
+	}
+	var state int32
+	candStart, candEnd := -1, -1
+	i := 0
+	for {
+		if i == len(text) {
+			if candStart < 0 {
+				return
+			}
+			fn(candStart, candEnd)
+			i, state = candEnd, 0
+			candStart, candEnd = -1, -1
+			continue
+		}
+		state = ac.next(state, text[i])
+		i++
+		if l := int(ac.nodes[state].out); l > 0 {
+			start := i - l
+			if candStart < 0 || start < candStart || (start == candStart && i > candEnd) {
+				candStart, candEnd = start, i
+			}
+		}
+		// 現在の状態が candStart より後ろから始まっているなら、
+		// candStart 以前から始まるマッチはもう現れない
+		if candStart >= 0 && i-int(ac.nodes[state].depth) > candStart {
+			fn(candStart, candEnd)
+			i, state = candEnd, 0
+			candStart, candEnd = -1, -1
+		}
+	}
+}
+
+// eachMatch は text 中のマッチを重なりや短いものも含めて全部列挙する
+func (ac *ahoCorasick) eachMatch(text string, fn func(start, end int)) {
+	ac.containsFunc(text, func(start, end int) bool {
+		fn(start, end)
+		return false
+	})
+}
+
+// containsFunc は text 中のマッチのうち ok(start, end) が true になるものがあるかを返す。
+// each と違い、重なったり短かったりするマッチも全部試す
+func (ac *ahoCorasick) containsFunc(text string, ok func(start, end int) bool) bool {
+	if ac == nil || len(ac.nodes) <= 1 {
+		return false
+	}
+	var state int32
+	for i := 0; i < len(text); i++ {
+		state = ac.next(state, text[i])
+		// fail を辿り、ここで終わるパターンを長い順に試す
+		for s := state; s != 0 && ac.nodes[s].out > 0; s = ac.nodes[s].fail {
+			if n := ac.nodes[s]; n.out == n.depth && ok(i+1-int(n.depth), i+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains は text がどれかのパターンを含むかを返す
+func (ac *ahoCorasick) contains(text string) bool {
+	if ac == nil || len(ac.nodes) <= 1 {
+		return false
+	}
+	var state int32
+	for i := 0; i < len(text); i++ {
+		state = ac.next(state, text[i])
+		if ac.nodes[state].out > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// replaceWithReplacer は以前の htmlify と同じく、長い順に並べたキーワードを strings.NewReplacer に渡して印をつける
+func replaceWithReplacer(keywords []string, text string) string {
+	sorted := append([]string(nil), keywords...)
+	sort.Slice(sorted, func(i, j int) bool { return keywordLess(sorted[i], sorted[j]) })
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, kw := range sorted {
+		pairs = append(pairs, kw, "<"+kw+">")
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+func replaceWithAhoCorasick(keywords []string, text string) string {
+	var buf strings.Builder
+	last := 0
+	newAhoCorasick(keywords).each(text, func(start, end int) {
+		buf.WriteString(text[last:start])
+		buf.WriteString("<" + text[start:end] + ">")
+		last = end
+	})
+	buf.WriteString(text[last:])
+	return buf.String()
+}
+
+func TestAhoCorasickMatchesReplacer(t *testing.T) {
+	tests := []struct {
+		keywords []string
+		text     string
+	}{
+		{nil, "abc"},
+		{[]string{"a"}, ""},
+		{[]string{"a"}, "banana"},
+		{[]string{"ab", "abc"}, "abcd"},
+		{[]string{"ab", "bc"}, "abc"},
+		{[]string{"abc", "bcd", "cd"}, "abcde"},
+		{[]string{"he", "she", "his", "hers"}, "ushers and his sheep"},
+		{[]string{"aa", "aaa"}, "aaaaaaa"},
+		{[]string{"b", "abcd"}, "abcabcd"},
+		{[]string{"isucon", "isu", "コン"}, "isuconのコンテスト isu"},
+		{[]string{"日本", "日本語", "本語"}, "日本語を話す日本人"},
+		{[]string{"x"}, "xyz\nxx"},
+	}
+	for _, tt := range tests {
+		want := replaceWithReplacer(tt.keywords, tt.text)
+		got := replaceWithAhoCorasick(tt.keywords, tt.text)
+		if got != want {
+			t.Errorf("keywords %q in %q: got %q, want %q", tt.keywords, tt.text, got, want)
+		}
+	}
+}
+
+func TestAhoCorasickOverlap(t *testing.T) {
+	var got [][2]int
+	newAhoCorasick([]string{"ab", "abc"}).each("abcd", func(start, end int) {
+		got = append(got, [2]int{start, end})
+	})
+	if len(got) != 1 || got[0] != [2]int{0, 3} {
+		t.Errorf("got %v, want [[0 3]]", got)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+// =====================
+//	JSON API (v1)
+// =====================
+
+const (
+	apiDefaultPerPage = 10
+	apiMaxPerPage     = 100
+)
+
+type apiEntryRequest struct {
+	Keyword     string `json:"keyword"`
+	Description string `json:"description"`
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	re.JSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": msg,
+		},
+	})
+}
+
+// apiHandler は myHandler の JSON 版。Accept で HTML を求められなければエラーも JSON で返す
+func apiHandler(fn handlerFunc) http.HandlerFunc {
+	return serveHandler(fn, true)
+}
+
+// apiAuthenticate はログインしていなければエラーを返す
+func apiAuthenticate(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+	if err := authenticate(w, r); err != nil {
+		return &UnauthorizedError{"login required"}
+	}
+	return nil
+}
+
+func apiKeyword(r *http.Request) string {
+	keyword, _ := url.PathUnescape(mux.Vars(r)["keyword"])
+	return keyword
+}
+
+func getEntries(limit, offset int) ([]*Entry, error) {
+	rows, err := db.Query(
+		"SELECT "+entryColumns+" FROM entry ORDER BY updated_at DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*Entry, 0, limit)
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+func apiEntriesHandler(w http.ResponseWriter, r *http.Request) error {
+	page, perPage, err := parsePaging(r, apiDefaultPerPage, apiMaxPerPage)
+	if err != nil {
+		return err
+	}
+
+	entries, err := getEntries(perPage, perPage*(page-1))
+	if err != nil {
+		return err
+	}
+	total, err := getEntryNumFromRedis()
+	if err != nil {
+		return err
+	}
+
+	re.JSON(w, http.StatusOK, map[string]interface{}{
+		"entries":  entries,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+	return nil
+}
+
+func apiEntryHandler(w http.ResponseWriter, r *http.Request) error {
+	e, err := getEntryByKeyword(apiKeyword(r))
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"entry not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.Html, err = getHTMLOfEntry(e); err != nil {
+		return err
+	}
+	if e.Stars, err = loadStars(e.Keyword); err != nil {
+		return err
+	}
+	re.JSON(w, http.StatusOK, map[string]interface{}{
+		"entry": e,
+	})
+	return nil
+}
+
+// POST /api/v1/entries は keyword を body で、PUT /api/v1/entries/{keyword} は URL で受け取る
+func apiEntryPutHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := apiAuthenticate(w, r); err != nil {
+		return err
+	}
+
+	var req apiEntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return &ValidationError{"invalid JSON body"}
+	}
+	if kw := apiKeyword(r); kw != "" {
+		req.Keyword = kw
+	}
+	if req.Keyword == "" {
+		return &ValidationError{"keyword is required"}
+	}
+
+	spam, err := isSpamContents(req.Description, req.Keyword)
+	if err != nil {
+		return err
+	}
+	if spam {
+		if err := queuePendingEntry(currentUser(r), req.Keyword, req.Description); err != nil {
+			return err
+		}
+		re.JSON(w, http.StatusAccepted, map[string]interface{}{
+			"status": pendingStatusPending,
+		})
+		return nil
+	}
+
+	_, err = getEntryByKeyword(req.Keyword)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	created := err == sql.ErrNoRows
+
+	if err := postEntry(currentUser(r), req.Keyword, req.Description); err != nil {
+		return err
+	}
+
+	e, err := getEntryByKeyword(req.Keyword)
+	if err != nil {
+		return err
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+		w.Header().Set("Location", "/api/v1/entries/"+pathURIEscape(e.Keyword))
+	}
+	re.JSON(w, code, map[string]interface{}{
+		"entry": e,
+	})
+	return nil
+}
+
+func apiEntryDeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := apiAuthenticate(w, r); err != nil {
+		return err
+	}
+
+	keyword := apiKeyword(r)
+	_, err := getEntryByKeyword(keyword)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"entry not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := deleteEntry(currentUser(r), keyword); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
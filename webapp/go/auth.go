@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+// エントリの編集・削除は作者と管理者だけができる。
+// protected なエントリは管理者しか編集・削除できない
+
+var errEntryForbidden = errors.New("you are not allowed to modify this entry")
+
+// currentUser は setName がコンテキストに入れたログインユーザーを返す
+func currentUser(r *http.Request) User {
+	u := User{}
+	u.ID, _ = getContext(r, "user_id").(int)
+	u.Name, _ = getContext(r, "user_name").(string)
+	u.IsAdmin, _ = getContext(r, "is_admin").(bool)
+	return u
+}
+
+// requireLogin はログインしていなければエラーを返す
+func requireLogin(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+	if err := authenticate(w, r); err != nil {
+		return &ForbiddenError{"Please login."}
+	}
+	return nil
+}
+
+func canModifyEntry(u User, authorID int, protected bool) bool {
+	if u.IsAdmin {
+		return true
+	}
+	if protected {
+		return false
+	}
+	return u.ID == authorID
+}
+
+// authorizeEntry は keyword のエントリを行ロックして u が変更できるか確かめる。
+// エントリがまだない場合は誰でも作れる
+func authorizeEntry(tx *sql.Tx, u User, keyword string) error {
+	var authorID int
+	var protected bool
+	err := tx.QueryRow(`SELECT author_id, protected FROM entry WHERE keyword = ? FOR UPDATE`, keyword).Scan(&authorID, &protected)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !canModifyEntry(u, authorID, protected) {
+		return errEntryForbidden
+	}
+	return nil
+}
+
+func setEntryProtected(u User, keyword string, protected bool) error {
+	if !u.IsAdmin {
+		return errEntryForbidden
+	}
+	// 値が変わらないと MySQL は RowsAffected を 0 にするので、あるかどうかは別に確かめる
+	return runInTx(func(u *unitOfWork) error {
+		var id int64
+		if err := u.Tx.QueryRow(`SELECT id FROM entry WHERE keyword = ? FOR UPDATE`, keyword).Scan(&id); err != nil {
+			return err
+		}
+		_, err := u.Tx.Exec(`UPDATE entry SET protected = ? WHERE id = ?`, protected, id)
+		return err
+	})
+}
+
+func keywordProtectHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
+	}
+
+	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
+	err := setEntryProtected(currentUser(r), keyword, r.FormValue("protected") != "")
+	if err == errEntryForbidden {
+		return &ForbiddenError{"Only administrators can protect keywords."}
+	}
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"keyword not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/keyword/"+pathURIEscape(keyword), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// =====================
+//	被リンク
+// =====================
+// LINKS-<entry> と LINKED-BY-<keyword> を htmlify と同じマッチャーで常に全エントリ分そろえておく。
+// 起動時と initialize で作り直し、あとは投稿と削除で影響のあるエントリだけ更新する
+
+// keywordBacklinksPreview は keyword ページに表示する被リンクの数
+const keywordBacklinksPreview = 20
+
+// linksOf は htmlify がリンクにするキーワードを重複なしで返す
+func linksOf(content string) []string {
+	var links []string
+	linked := make(map[string]struct{})
+	keywordIdx.Snapshot().Each(content, func(start, end int) {
+		kw := content[start:end]
+		if _, ok := linked[kw]; !ok {
+			linked[kw] = struct{}{}
+			links = append(links, kw)
+		}
+	})
+	return links
+}
+
+// rebuildEntryLinks は全エントリのリンクを計算し直す。キーワードのインデックスを作ったあとに呼ぶ
+func rebuildEntryLinks() error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	for _, pattern := range []string{linksKeyPrefix + "*", linkedByKeyPrefix + "*"} {
+		keys, err := r.ScanKeysInCache(pattern)
+		if err != nil {
+			return err
+		}
+		if err := r.RemoveKeyFromCache(keys...); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(`SELECT keyword, description FROM entry`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	linkedBy := make(map[string][]interface{})
+	for rows.Next() {
+		var keyword, description string
+		if err := rows.Scan(&keyword, &description); err != nil {
+			return err
+		}
+		links := linksOf(description)
+		if len(links) == 0 {
+			continue
+		}
+		members := make([]interface{}, 0, len(links))
+		for _, kw := range links {
+			members = append(members, kw)
+			linkedBy[kw] = append(linkedBy[kw], keyword)
+		}
+		if err := r.PushSetMembersToCache(linksKeyPrefix+keyword, members...); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for kw, entries := range linkedBy {
+		if err := r.PushSetMembersToCache(linkedByKeyPrefix+kw, entries...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relinkEntries は指定したエントリのリンクを今のキーワードで計算し直す
+func relinkEntries(keywords []string) error {
+	if len(keywords) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keywords))
+	for _, kw := range keywords {
+		args = append(args, kw)
+	}
+	rows, err := db.Query(
+		`SELECT keyword, description FROM entry WHERE keyword IN (?`+strings.Repeat(",?", len(args)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var keyword, description string
+		if err := rows.Scan(&keyword, &description); err != nil {
+			return err
+		}
+		if err := setEntryLinks(keyword, linksOf(description)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// getBacklinks は keyword をリンクしているエントリをキーワード順に返す
+func getBacklinks(keyword string) ([]string, error) {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	entries, err := getEntriesLinkingTo(r, keyword)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+func keywordBacklinksHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+
+	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
+	_, err := getEntryByKeyword(keyword)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"keyword not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	backlinks, err := getBacklinks(keyword)
+	if err != nil {
+		return err
+	}
+
+	re.HTML(w, http.StatusOK, "backlinks", struct {
+		Context   context.Context
+		Keyword   string
+		Backlinks []string
+	}{
+		r.Context(), keyword, backlinks,
+	})
+	return nil
+}
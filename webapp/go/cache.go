@@ -1,14 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
 	"strconv"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 const (
-	entryNumKey   = "entryNum"
-	htmlKeyPrefix = "HTML-OF-"
+	entryNumKey = "entryNum"
+	// entryNum-PENDING はコミットを待っている entryNum の増減の集合。score は増減した時刻
+	entryNumPendingKey = "entryNum-PENDING"
+	htmlKeyPrefix      = "HTML-OF-"
+	// HTML-VERSION-<entry> は HTML-OF-<entry> を無効にするたびに増やす
+	htmlVersionKeyPrefix = "HTML-VERSION-"
 	// starPrefix = "STAR-"
 )
 
@@ -31,22 +40,33 @@ func flushAll() error {
 	return nil
 }
 
-func setHTMLOfEntryToRedis(keyword string, html string) error {
-	conn := redisPool.Get()
-	defer conn.Close()
-	key := htmlKeyPrefix + keyword
-	_, err := conn.Do("SET", key, html)
-	return err
-}
-
-func getHTMLOfEntryfromRedis(keyword string) (string, error) {
+// getOrRenderHTMLOfEntry はキャッシュされた HTML を返す。なければ render してキャッシュする。
+// render している間に無効にされた場合は、古いキーワードで作った HTML かもしれないのでキャッシュしない
+func getOrRenderHTMLOfEntry(keyword string, render func() (string, error)) (string, error) {
 	conn := redisPool.Get()
 	defer conn.Close()
 
-	key := htmlKeyPrefix + keyword
+	if _, err := conn.Do("WATCH", htmlVersionKeyPrefix+keyword); err != nil {
+		return "", err
+	}
+	html, err := redis.String(conn.Do("GET", htmlKeyPrefix+keyword))
+	if err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		return html, err
+	}
+	html, err = render()
+	if err != nil {
+		conn.Do("UNWATCH")
+		return "", err
+	}
 
-	html, err := redis.String(conn.Do("GET", key))
-	return html, err
+	conn.Send("MULTI")
+	conn.Send("SET", htmlKeyPrefix+keyword, html)
+	// 無効にされていれば EXEC は何もせずに nil を返す
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	return html, nil
 }
 
 func setEntryNumToRedis(num int64) error {
@@ -63,25 +83,211 @@ func getEntryNumFromRedis() (int64, error) {
 	return num, err
 }
 
-func incEntryNum() {
-	conn := redisPool.Get()
-	defer conn.Close()
-	num, err := redis.Int64(conn.Do("GET", entryNumKey))
-	panicIf(err)
-	_, err = conn.Do("SET", entryNumKey, strconv.FormatInt(num+1, 10))
-	panicIf(err)
+// entryNumPendingTimeout より前の増減は、コミットのあとで集合から消す前に落ちたものとみなす
+const entryNumPendingTimeout = time.Minute
+
+// addEntryNum は u のトランザクションに合わせて entryNum を delta だけ増やす。
+// ロールバックされたら元に戻す。コミットして集合から消すまでは entryNum-PENDING に残し、
+// reconcileEntryNum にコミット前の行数で上書きさせない
+func addEntryNum(u *unitOfWork, delta int64) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	err := u.Do(func() error {
+		conn := redisPool.Get()
+		defer conn.Close()
+		conn.Send("MULTI")
+		conn.Send("ZADD", entryNumPendingKey, time.Now().Unix(), token)
+		conn.Send("INCRBY", entryNumKey, delta)
+		_, err := conn.Do("EXEC")
+		return err
+	}, func() error {
+		conn := redisPool.Get()
+		defer conn.Close()
+		conn.Send("MULTI")
+		conn.Send("INCRBY", entryNumKey, -delta)
+		conn.Send("ZREM", entryNumPendingKey, token)
+		_, err := conn.Do("EXEC")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// 消せなくても entryNumPendingTimeout のあいだ数え直しが止まるだけ
+	u.AfterCommit(func() error {
+		conn := redisPool.Get()
+		defer conn.Close()
+		_, err := conn.Do("ZREM", entryNumPendingKey, token)
+		return err
+	})
+	return nil
 }
 
-func decEntryNum() {
+// reconcileEntryNum は entryNum を SELECT COUNT(*) に合わせる。
+// コミットを待っている増減があれば COUNT(*) と entryNum のどちらに含まれているかわからないので何もしない。
+// 数えている間に増減が始まった場合も entryNum か entryNum-PENDING が変わり、EXEC が失敗する (次の回で合わせる)
+func reconcileEntryNum() error {
 	conn := redisPool.Get()
 	defer conn.Close()
-	num, err := redis.Int64(conn.Do("GET", entryNumKey))
-	panicIf(err)
-	_, err = conn.Do("SET", entryNumKey, strconv.FormatInt(num-1, 10))
-	panicIf(err)
+
+	stale := time.Now().Add(-entryNumPendingTimeout).Unix()
+	if _, err := conn.Do("ZREMRANGEBYSCORE", entryNumPendingKey, "-inf", stale); err != nil {
+		return err
+	}
+	if _, err := conn.Do("WATCH", entryNumKey, entryNumPendingKey); err != nil {
+		return err
+	}
+	pending, err := redis.Int64(conn.Do("ZCARD", entryNumPendingKey))
+	if err != nil || pending > 0 {
+		conn.Do("UNWATCH")
+		return err
+	}
+	var count int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM entry`).Scan(&count); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+	before, err := redis.Int64(conn.Do("GET", entryNumKey))
+	if err != nil && err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		return err
+	}
+	if err == nil && before == count {
+		_, err = conn.Do("UNWATCH")
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", entryNumKey, strconv.FormatInt(count, 10))
+	res, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if res != nil {
+		log.Printf("entryNum reconciled: %d -> %d", before, count)
+	}
+	return nil
+}
+
+func startEntryNumReconciler(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			if err := reconcileEntryNum(); err != nil {
+				log.Printf("failed to reconcile entryNum: %s", err)
+			}
+		}
+	}()
 }
 
 func (r *Redisful) setEntryNumToRedis(num int64) error {
 	_, err := r.Conn.Do("SET", entryNumKey, strconv.FormatInt(num, 10))
 	return err
 }
+
+// =============================
+// 	HTML キャッシュの依存関係
+// =============================
+// LINKS-<entry>      : entry の本文がリンクしているキーワードの集合
+// LINKED-BY-<keyword>: keyword をリンクしているエントリの集合
+// HTML-OF-<entry> がキャッシュされているエントリは必ず LINKS-<entry> が記録されている
+
+const (
+	linksKeyPrefix    = "LINKS-"
+	linkedByKeyPrefix = "LINKED-BY-"
+)
+
+func decodeStringSet(data [][]byte) ([]string, error) {
+	strs := make([]string, 0, len(data))
+	for _, d := range data {
+		var s string
+		if err := json.Unmarshal(d, &s); err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func getEntryLinks(r *Redisful, keyword string) ([]string, error) {
+	data, err := r.GetSetFromCache(linksKeyPrefix + keyword)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStringSet(data)
+}
+
+func getEntriesLinkingTo(r *Redisful, keyword string) ([]string, error) {
+	data, err := r.GetSetFromCache(linkedByKeyPrefix + keyword)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStringSet(data)
+}
+
+// setEntryLinks は entry のリンク先を links に置き換える
+func setEntryLinks(keyword string, links []string) error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	old, err := getEntryLinks(r, keyword)
+	if err != nil {
+		return err
+	}
+	next := make(map[string]struct{}, len(links))
+	for _, kw := range links {
+		next[kw] = struct{}{}
+	}
+	for _, kw := range old {
+		if _, ok := next[kw]; ok {
+			delete(next, kw)
+			continue
+		}
+		if err := r.RemoveSetFromCache(linksKeyPrefix+keyword, kw); err != nil {
+			return err
+		}
+		if err := r.RemoveSetFromCache(linkedByKeyPrefix+kw, keyword); err != nil {
+			return err
+		}
+	}
+	for kw := range next {
+		if err := r.PushSetToCache(linksKeyPrefix+keyword, kw); err != nil {
+			return err
+		}
+		if err := r.PushSetToCache(linkedByKeyPrefix+kw, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateHTMLOfEntries は指定したエントリの HTML キャッシュを消す
+func invalidateHTMLOfEntries(keywords []string) error {
+	if len(keywords) == 0 {
+		return nil
+	}
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, kw := range keywords {
+		conn.Send("INCR", htmlVersionKeyPrefix+kw)
+		conn.Send("DEL", htmlKeyPrefix+kw)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// removeEntryLinks は削除されたエントリを依存関係から外す
+func removeEntryLinks(keyword string) error {
+	if err := setEntryLinks(keyword, nil); err != nil {
+		return err
+	}
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+	return r.RemoveKeyFromCache(linksKeyPrefix+keyword, linkedByKeyPrefix+keyword)
+}
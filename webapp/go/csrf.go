@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ログインしていればセッションに、していなければ署名つきのクッキーに CSRF トークンを持たせ、
+// 状態を変えるリクエストではフォームの csrf_token か X-CSRF-Token ヘッダーで同じトークンを送ってもらう。
+// ログインしていない人のためにセッションを保存すると、Redis のセッションが訪問者の数だけ増えてしまう
+const (
+	csrfTokenKey    = "csrf_token"
+	csrfTokenHeader = "X-CSRF-Token"
+	csrfCookieName  = "isuda_csrf"
+)
+
+var csrfCookies *csrfCookieStore
+
+// csrfCookieStore はログインしていない人の CSRF トークンをクッキーに入れる。
+// セッションと同じ鍵で署名するので、ほかのサイトから好きな値のクッキーを入れられても通らない
+type csrfCookieStore struct {
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+func newCSRFCookieStore(opts *sessions.Options, keyPairs ...[]byte) *csrfCookieStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(opts.MaxAge)
+		}
+	}
+	return &csrfCookieStore{codecs: codecs, options: opts}
+}
+
+// token はクッキーのトークンを返す。なければ作ってクッキーに入れる
+func (s *csrfCookieStore) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(csrfCookieName); err == nil {
+		var token string
+		if err := securecookie.DecodeMulti(csrfCookieName, c.Value, &token, s.codecs...); err == nil && token != "" {
+			return token, nil
+		}
+	}
+	token := newCSRFToken()
+	encoded, err := securecookie.EncodeMulti(csrfCookieName, token, s.codecs...)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, sessions.NewCookie(csrfCookieName, encoded, s.options))
+	return token, nil
+}
+
+func newCSRFToken() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// ensureCSRFToken はトークンを返す。ログインしていればセッションのトークンで、なければ作ってセッションに保存する
+func ensureCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session := getSession(w, r)
+	if _, ok := session.Values["user_id"]; !ok {
+		return csrfCookies.token(w, r)
+	}
+	if token, ok := session.Values[csrfTokenKey].(string); ok && token != "" {
+		return token, nil
+	}
+	token := newCSRFToken()
+	session.Values[csrfTokenKey] = token
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func validCSRFToken(r *http.Request, token string) bool {
+	got := r.Header.Get(csrfTokenHeader)
+	if got == "" {
+		got = r.PostFormValue(csrfTokenKey)
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// csrfProtect はトークンをコンテキストに入れ、安全でないメソッドならトークンを検証する
+func csrfProtect(fn handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token, err := ensureCSRFToken(w, r)
+		if err != nil {
+			return err
+		}
+		setContext(r, csrfTokenKey, token)
+
+		if !isSafeMethod(r.Method) && !validCSRFToken(r, token) {
+			return &ForbiddenError{"invalid CSRF token"}
+		}
+		return fn(w, r)
+	}
+}
+
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) error {
+	re.JSON(w, http.StatusOK, map[string]string{
+		"csrf_token": getContext(r, csrfTokenKey).(string),
+	})
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// =====================
+//	差分
+// =====================
+// 行単位で Myers の差分をとり、置き換えられた行どうしは文字 (rune) 単位でも差分をとる
+
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffDelete
+	diffInsert
+)
+
+// diffContextLines は変更の前後に表示する変更のない行の数
+const diffContextLines = 3
+
+// diffMaxEdits は myersDiff で探す編集の数の上限。
+// 途中の v を d ごとに残すのでメモリは上限の 2 乗に比例する (1000 で 8MB ほど)
+const diffMaxEdits = 1000
+
+type diffOp struct {
+	Kind diffKind
+	// a[A] か b[B] の位置。Insert のときの A、Delete のときの B は使わない
+	A, B int
+}
+
+// myersDiff は長さ n の a を長さ m の b にする最短の編集を返す。eq(i, j) は a[i] == b[j]。
+// 編集が maxD 回より多く必要なら探すのをやめて false を返す
+func myersDiff(n, m, maxD int, eq func(i, j int) bool) ([]diffOp, bool) {
+	max := n + m
+	if maxD < max {
+		max = maxD
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] は d 回目が終わったときの v[-d..d]
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && eq(x, y) {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[off-d:off+d+1])
+		trace = append(trace, snapshot)
+	}
+	if !found {
+		return nil, false
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{diffEqual, x, y})
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{diffInsert, x, prevY})
+		} else {
+			ops = append(ops, diffOp{diffDelete, prevX, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{diffEqual, x, y})
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// DiffSegment は 1 行の中の同じ種類の文字の並び
+type DiffSegment struct {
+	Changed bool
+	Text    string
+}
+
+// DiffLine は表示する 1 行。Kind は "equal", "delete", "insert", "skip"
+type DiffLine struct {
+	Kind     string
+	OldNo    int
+	NewNo    int
+	Segments []DiffSegment
+}
+
+func splitDiffLines(s string) []string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffRunes は置き換えられた 1 行どうしの文字単位の差分を返す。
+// 共通部分がほとんどないか、違いが多すぎれば行全体を変更として扱う
+func diffRunes(a, b string) (del, ins []DiffSegment) {
+	ra, rb := []rune(a), []rune(b)
+	ops, ok := myersDiff(len(ra), len(rb), diffMaxEdits, func(i, j int) bool { return ra[i] == rb[j] })
+	if !ok {
+		return []DiffSegment{{true, a}}, []DiffSegment{{true, b}}
+	}
+
+	common := 0
+	for _, op := range ops {
+		if op.Kind == diffEqual {
+			common++
+		}
+	}
+	if common*4 < len(ra)+len(rb) {
+		return []DiffSegment{{true, a}}, []DiffSegment{{true, b}}
+	}
+
+	appendRune := func(segs []DiffSegment, changed bool, r rune) []DiffSegment {
+		if n := len(segs); n > 0 && segs[n-1].Changed == changed {
+			segs[n-1].Text += string(r)
+			return segs
+		}
+		return append(segs, DiffSegment{changed, string(r)})
+	}
+	for _, op := range ops {
+		switch op.Kind {
+		case diffEqual:
+			del = appendRune(del, false, ra[op.A])
+			ins = appendRune(ins, false, rb[op.B])
+		case diffDelete:
+			del = appendRune(del, true, ra[op.A])
+		case diffInsert:
+			ins = appendRune(ins, true, rb[op.B])
+		}
+	}
+	return del, ins
+}
+
+// diffText は old から new への差分を表示用の行にする
+func diffText(old, new string) []DiffLine {
+	a, b := splitDiffLines(old), splitDiffLines(new)
+	ops, ok := myersDiff(len(a), len(b), diffMaxEdits, func(i, j int) bool { return a[i] == b[j] })
+	if !ok {
+		// 違いが多すぎるときは全部消して全部足したことにする
+		ops = make([]diffOp, 0, len(a)+len(b))
+		for i := range a {
+			ops = append(ops, diffOp{diffDelete, i, 0})
+		}
+		for j := range b {
+			ops = append(ops, diffOp{diffInsert, 0, j})
+		}
+	}
+
+	lines := make([]DiffLine, 0, len(ops))
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == diffEqual {
+			op := ops[i]
+			lines = append(lines, DiffLine{"equal", op.A + 1, op.B + 1, []DiffSegment{{false, a[op.A]}}})
+			i++
+			continue
+		}
+
+		// 連続した削除と追加をまとめ、前から順に対応させる
+		var dels, inss []diffOp
+		for ; i < len(ops) && ops[i].Kind != diffEqual; i++ {
+			if ops[i].Kind == diffDelete {
+				dels = append(dels, ops[i])
+			} else {
+				inss = append(inss, ops[i])
+			}
+		}
+		delLines := make([]DiffLine, len(dels))
+		insLines := make([]DiffLine, len(inss))
+		for j, op := range dels {
+			delLines[j] = DiffLine{"delete", op.A + 1, 0, []DiffSegment{{true, a[op.A]}}}
+		}
+		for j, op := range inss {
+			insLines[j] = DiffLine{"insert", 0, op.B + 1, []DiffSegment{{true, b[op.B]}}}
+		}
+		for j := 0; j < len(dels) && j < len(inss); j++ {
+			delLines[j].Segments, insLines[j].Segments = diffRunes(a[dels[j].A], b[inss[j].B])
+		}
+		lines = append(lines, delLines...)
+		lines = append(lines, insLines...)
+	}
+	return collapseDiffContext(lines)
+}
+
+// collapseDiffContext は変更から離れた変更のない行を "skip" の 1 行にまとめる
+func collapseDiffContext(lines []DiffLine) []DiffLine {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Kind == "equal" {
+			continue
+		}
+		for j := i - diffContextLines; j <= i+diffContextLines; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	collapsed := make([]DiffLine, 0, len(lines))
+	for i, l := range lines {
+		if keep[i] {
+			collapsed = append(collapsed, l)
+			continue
+		}
+		if n := len(collapsed); n == 0 || collapsed[n-1].Kind != "skip" {
+			collapsed = append(collapsed, DiffLine{Kind: "skip"})
+		}
+	}
+	return collapsed
+}
+
+// getLatestRevisionIDs は keyword の新しい順に 2 つまでの版の ID を返す
+func getLatestRevisionIDs(keyword string) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM entry_revision WHERE keyword = ? ORDER BY id DESC LIMIT 2`, keyword)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, 2)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func getPreviousRevisionID(keyword string, id int64) (int64, error) {
+	var prev int64
+	err := db.QueryRow(`SELECT id FROM entry_revision WHERE keyword = ? AND id < ? ORDER BY id DESC LIMIT 1`, keyword, id).Scan(&prev)
+	return prev, err
+}
+
+// keywordDiffHandler は from の版から to の版への差分を表示する。
+// to を省略すると最新の版、from を省略すると to の 1 つ前の版
+func keywordDiffHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+
+	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
+	parseID := func(name string) (int64, bool) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return 0, true
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		return id, err == nil && id > 0
+	}
+	fromID, ok := parseID("from")
+	if !ok {
+		return &ValidationError{"invalid from"}
+	}
+	toID, ok := parseID("to")
+	if !ok {
+		return &ValidationError{"invalid to"}
+	}
+
+	if toID == 0 {
+		ids, err := getLatestRevisionIDs(keyword)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return &NotFoundError{"keyword not found"}
+		}
+		toID = ids[0]
+	}
+	if fromID == 0 {
+		prev, err := getPreviousRevisionID(keyword, toID)
+		if err == sql.ErrNoRows {
+			// 最初の版は空との差分
+			prev, err = 0, nil
+		}
+		if err != nil {
+			return err
+		}
+		fromID = prev
+	}
+
+	var from Revision
+	if fromID != 0 {
+		var err error
+		from, err = getRevision(keyword, fromID)
+		if err == sql.ErrNoRows {
+			return &NotFoundError{"revision not found"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	to, err := getRevision(keyword, toID)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"revision not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	re.HTML(w, http.StatusOK, "diff", struct {
+		Context context.Context
+		Keyword string
+		From    Revision
+		To      Revision
+		Lines   []DiffLine
+	}{
+		r.Context(), keyword, from, to, diffText(from.Description, to.Description),
+	})
+	return nil
+}
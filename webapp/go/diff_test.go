@@ -0,0 +1,148 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// applyDiffOps は ops から両側の列を組み立て直す
+func applyDiffOps(t *testing.T, a, b []string, ops []diffOp) (old, new []string) {
+	for _, op := range ops {
+		switch op.Kind {
+		case diffEqual:
+			if a[op.A] != b[op.B] {
+				t.Fatalf("equal op pairs %q with %q", a[op.A], b[op.B])
+			}
+			old = append(old, a[op.A])
+			new = append(new, b[op.B])
+		case diffDelete:
+			old = append(old, a[op.A])
+		case diffInsert:
+			new = append(new, b[op.B])
+		}
+	}
+	return old, new
+}
+
+func TestMyersDiffRebuildsBothSides(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		edits int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abc", "abc", 0},
+		{"abcabba", "cbabac", 5},
+		{"あいう", "あxう", 2},
+	}
+	for _, tt := range tests {
+		a, b := strings.Split(tt.a, ""), strings.Split(tt.b, "")
+		ops, ok := myersDiff(len(a), len(b), diffMaxEdits, func(i, j int) bool { return a[i] == b[j] })
+		if !ok {
+			t.Fatalf("%q -> %q: gave up", tt.a, tt.b)
+		}
+		old, new := applyDiffOps(t, a, b, ops)
+		if strings.Join(old, "") != tt.a || strings.Join(new, "") != tt.b {
+			t.Errorf("%q -> %q: rebuilt %q -> %q", tt.a, tt.b, strings.Join(old, ""), strings.Join(new, ""))
+		}
+		edits := 0
+		for _, op := range ops {
+			if op.Kind != diffEqual {
+				edits++
+			}
+		}
+		if edits != tt.edits {
+			t.Errorf("%q -> %q: %d edits, want %d", tt.a, tt.b, edits, tt.edits)
+		}
+	}
+}
+
+// diffLineString は DiffLine を "kind old new text" にし、変更された部分を [] で囲む
+func diffLineString(l DiffLine) string {
+	var buf strings.Builder
+	buf.WriteString(l.Kind)
+	for _, s := range l.Segments {
+		if s.Changed {
+			buf.WriteString(" [" + s.Text + "]")
+		} else {
+			buf.WriteString(" " + s.Text)
+		}
+	}
+	return buf.String()
+}
+
+func TestDiffText(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     []string
+	}{
+		{"empty to text", "", "a\nb", []string{"insert [a]", "insert [b]"}},
+		{"text to empty", "a\nb\n", "", []string{"delete [a]", "delete [b]"}},
+		{"identical", "a\nb", "a\nb", []string{"skip"}},
+		{"single line change", "一行目\n二行目です", "一行目\n二行目でした", []string{
+			"equal 一行目",
+			"delete 二行目で [す]",
+			"insert 二行目で [した]",
+		}},
+		{"crlf", "a\r\nb\r\n", "a\nc\n", []string{"equal a", "delete [b]", "insert [c]"}},
+		{"crlf identical", "a\r\nb", "a\nb\n", []string{"skip"}},
+	}
+	for _, tt := range tests {
+		lines := diffText(tt.old, tt.new)
+		got := make([]string, 0, len(lines))
+		for _, l := range lines {
+			got = append(got, diffLineString(l))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffTextLineNumbers(t *testing.T) {
+	lines := diffText("a\nb\nc", "a\nc\nd")
+	want := [][2]int{{1, 1}, {2, 0}, {3, 2}, {0, 3}}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, l := range lines {
+		if l.OldNo != want[i][0] || l.NewNo != want[i][1] {
+			t.Errorf("line %d: got %d/%d, want %d/%d", i, l.OldNo, l.NewNo, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestMyersDiffGivesUp(t *testing.T) {
+	if _, ok := myersDiff(3, 3, 2, func(i, j int) bool { return false }); ok {
+		t.Error("6 edits should exceed maxD 2")
+	}
+	if _, ok := myersDiff(3, 3, 6, func(i, j int) bool { return false }); !ok {
+		t.Error("6 edits should fit in maxD 6")
+	}
+}
+
+// 長い行どうしでも差分をとるメモリが上限で抑えられることを確かめる
+func TestDiffTextLongLines(t *testing.T) {
+	const n = 4000
+	var a, b strings.Builder
+	for i := 0; i < n; i++ {
+		a.WriteRune(rune(0x4e00 + i))
+		b.WriteRune(rune(0x4e00 + n + i))
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	lines := diffText(a.String(), b.String())
+	runtime.ReadMemStats(&after)
+
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("allocated %d bytes", alloc)
+	}
+	want := []string{"delete [" + a.String() + "]", "insert [" + b.String() + "]"}
+	if len(lines) != 2 || diffLineString(lines[0]) != want[0] || diffLineString(lines[1]) != want[1] {
+		t.Errorf("long lines should be replaced as a whole, got %d lines", len(lines))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// =====================
+//	エラー応答
+// =====================
+// ハンドラはエラーを返し、myHandler と apiHandler がそれを応答にする。
+// 下の型のエラーはそのステータスコードとメッセージで返し、それ以外は 500 にしてログに残す。
+// Accept で JSON と HTML のどちらを好むか決め、決まらなければ API は JSON、画面は HTML で返す
+
+// httpError はステータスコードを持つエラー
+type httpError interface {
+	error
+	StatusCode() int
+}
+
+func errorMessage(msg string, code int) string {
+	if msg == "" {
+		return http.StatusText(code)
+	}
+	return msg
+}
+
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *ValidationError) StatusCode() int { return http.StatusBadRequest }
+
+// UnauthorizedError は API でログインが必要なときのエラー
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *UnauthorizedError) StatusCode() int { return http.StatusUnauthorized }
+
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *ForbiddenError) StatusCode() int { return http.StatusForbidden }
+
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *NotFoundError) StatusCode() int { return http.StatusNotFound }
+
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *ConflictError) StatusCode() int { return http.StatusConflict }
+
+// TooManyRequestsError はレート制限にかかったときのエラー
+type TooManyRequestsError struct {
+	Message string
+}
+
+func (e *TooManyRequestsError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *TooManyRequestsError) StatusCode() int { return http.StatusTooManyRequests }
+
+// UpstreamError は依存先が使えないときのエラー。Err は応答には含めずログにだけ出す
+type UpstreamError struct {
+	Message string
+	Err     error
+}
+
+func (e *UpstreamError) Error() string   { return errorMessage(e.Message, e.StatusCode()) }
+func (e *UpstreamError) StatusCode() int { return http.StatusServiceUnavailable }
+
+func isDuplicateEntry(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number == mysqlErrDupEntry
+}
+
+// toHTTPError はエラーを応答に使う httpError にする。知らないエラーなら nil
+func toHTTPError(err error) httpError {
+	if he, ok := err.(httpError); ok {
+		return he
+	}
+	switch err {
+	case errInvalidUser:
+		return &ForbiddenError{"invalid user"}
+	case errEntryForbidden:
+		return &ForbiddenError{"Only the author or an administrator can modify this keyword."}
+	case errPendingEntryReviewed:
+		return &ConflictError{"This post has already been reviewed."}
+	case errSpamCheckerUnavailable:
+		return &UpstreamError{"The spam checker is unavailable. Please try again later.", err}
+	}
+	if isDuplicateEntry(err) {
+		return &ConflictError{"already exists"}
+	}
+	return nil
+}
+
+// writeError は err をステータスコードつきの HTML か JSON で返す
+func writeError(w http.ResponseWriter, r *http.Request, err error, preferJSON bool) {
+	code, msg := http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	if he := toHTTPError(err); he != nil {
+		code, msg = he.StatusCode(), he.Error()
+		if ue, ok := he.(*UpstreamError); ok && ue.Err != nil {
+			err = ue.Err
+		}
+	}
+	if code >= http.StatusInternalServerError {
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+	}
+
+	if wantsJSON(r, preferJSON) {
+		apiError(w, code, msg)
+		return
+	}
+	renderError(w, r, code, msg)
+}
+
+// renderError はエラーページを表示する
+func renderError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	re.HTML(w, code, "error", struct {
+		Context context.Context
+		Code    int
+		Title   string
+		Message string
+	}{
+		r.Context(), code, http.StatusText(code), msg,
+	})
+}
+
+// wantsJSON は Accept で JSON と HTML のどちらの q が高いかを見る。同じなら preferJSON
+func wantsJSON(r *http.Request, preferJSON bool) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[len("q="):], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case "text/html":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+	if jsonQ != htmlQ {
+		return jsonQ > htmlQ
+	}
+	return preferJSON
+}
@@ -0,0 +1,94 @@
+// fakeisupam は isupam の代わりに使う手元用のスパム判定サーバー。
+// NG ワードを含む content を spam と判定する。遅延やエラーを混ぜて
+// isuda の spam checker のタイムアウトやサーキットブレーカーを試せる
+//
+//	go run ./fakeisupam -addr :5050 -words ng.txt -delay 200ms -error-rate 0.3
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	addr      = flag.String("addr", ":5050", "listen address")
+	wordsFile = flag.String("words", "", "file of NG words, one per line")
+	delay     = flag.Duration("delay", 0, "delay before every response")
+	errorRate = flag.Float64("error-rate", 0, "fraction of requests answered with 500")
+	down      = flag.Bool("down", false, "answer every request with 503")
+)
+
+var defaultWords = []string{"spam", "スパム"}
+
+func loadWords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if w := strings.TrimSpace(sc.Text()); w != "" {
+			words = append(words, w)
+		}
+	}
+	return words, sc.Err()
+}
+
+func main() {
+	flag.Parse()
+
+	words := defaultWords
+	if *wordsFile != "" {
+		var err error
+		words, err = loadWords(*wordsFile)
+		if err != nil {
+			log.Fatalf("Failed to load %s: %s.", *wordsFile, err.Error())
+		}
+	}
+
+	var requests int64
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+		if *down {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if rand.Float64() < *errorRate {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		content := r.FormValue("content")
+		valid := true
+		for _, word := range words {
+			if strings.Contains(content, word) {
+				valid = false
+				break
+			}
+		}
+		log.Printf("#%d valid=%v (%d bytes)", n, valid, len(content))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"valid": valid})
+	})
+
+	log.Printf("fake isupam listening on %s with %d NG words", *addr, len(words))
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
@@ -14,12 +12,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/Songmu/strrand"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -29,18 +25,19 @@ import (
 )
 
 const (
-	sessionName   = "isuda_session"
-	sessionSecret = "tonymoris"
+	sessionName = "isuda_session"
 )
 
 var (
 	isutarEndpoint string
 	isupamEndpoint string
 
-	baseUrl *url.URL
-	db      *sql.DB
-	re      *render.Render
-	store   *sessions.CookieStore
+	// 設定されていれば、リクエストのホストによらずこの origin で URL を組み立てる
+	canonicalOrigin *url.URL
+
+	db    *sql.DB
+	re    *render.Render
+	store sessions.Store
 
 	redisPool = &redis.Pool{
 		MaxIdle:     3,
@@ -50,9 +47,9 @@ var (
 	}
 
 	errInvalidUser = errors.New("Invalid User")
+	errLoginFailed = &ForbiddenError{"The name or password is incorrect."}
 
-	keywordPairList []string
-	kw2sha          = make(map[string]string)
+	keywordIdx = newKeywordIndex()
 )
 
 func setName(w http.ResponseWriter, r *http.Request) error {
@@ -61,17 +58,19 @@ func setName(w http.ResponseWriter, r *http.Request) error {
 	if !ok {
 		return nil
 	}
-	setContext(r, "user_id", userID)
-	row := db.QueryRow(`SELECT name FROM user WHERE id = ?`, userID)
+	row := db.QueryRow(`SELECT id, name, is_admin FROM user WHERE id = ?`, userID)
 	user := User{}
-	err := row.Scan(&user.Name)
+	err := row.Scan(&user.ID, &user.Name, &user.IsAdmin)
+	if err == sql.ErrNoRows {
+		return errInvalidUser
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return errInvalidUser
-		}
-		panicIf(err)
+		return err
 	}
+	// セッションには int64 で入っていることもあるので DB の値で揃える
+	setContext(r, "user_id", user.ID)
 	setContext(r, "user_name", user.Name)
+	setContext(r, "is_admin", user.IsAdmin)
 	return nil
 }
 
@@ -82,11 +81,15 @@ func authenticate(w http.ResponseWriter, r *http.Request) error {
 	return errInvalidUser
 }
 
-func initializeHandler(w http.ResponseWriter, r *http.Request) {
+func initializeHandler(w http.ResponseWriter, r *http.Request) error {
 	_, err := db.Exec(`DELETE FROM entry WHERE id > 7101`)
-	panicIf(err)
+	if err != nil {
+		return err
+	}
+	if err := resetRevisions(); err != nil {
+		return err
+	}
 	var redisful *Redisful
-	defer redisful.Close()
 	for {
 		redisful, err = NewRedisful()
 		if err == nil {
@@ -95,92 +98,122 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Println("connection failed...")
 	}
-	err = redisful.FLUSH_ALL()
-	panicIf(err)
-	err = redisful.setEntryNumToRedis(7101)
-	panicIf(err)
-	err = initializeStar()
-	// panicIf(err)
+	defer redisful.Close()
+	if err := redisful.FLUSH_ALL(); err != nil {
+		return err
+	}
+	if err := redisful.setEntryNumToRedis(7101); err != nil {
+		return err
+	}
+	if err := initializeStar(); err != nil {
+		return err
+	}
 	err = initEntries()
-	// panicIf(err)
-	initReplacer()
+	// if err != nil {
+	// 	return err
+	// }
+	for _, init := range []func() error{
+		initKeywordIndex,
+		initSearchIndex,
+		rebuildEntryLinks,
+		rebuildSuggestIndex,
+		initializeModeration,
+	} {
+		if err := init(); err != nil {
+			return err
+		}
+	}
 	re.JSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	return nil
 }
 
-func getKeywordsByDesc() []string {
+func getKeywordsByDesc() ([]string, error) {
 	rows, err := db.Query(`
 		SELECT keyword FROM entry ORDER BY keyword_length DESC
 	`)
-	panicIf(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
 	var kws []string
 	for rows.Next() {
 		var kw string
-		err := rows.Scan(&kw)
-		panicIf(err)
+		if err := rows.Scan(&kw); err != nil {
+			return nil, err
+		}
 		kws = append(kws, kw)
 	}
+	return kws, rows.Err()
+}
+
+// getKeywordsOfEntriesContaining は本文に kw を含むエントリのキーワードを返す
+func getKeywordsOfEntriesContaining(kw string) ([]string, error) {
+	rows, err := db.Query(`SELECT keyword FROM entry WHERE INSTR(description, ?) > 0`, kw)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
-	return kws
+
+	var kws []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		kws = append(kws, k)
+	}
+	return kws, rows.Err()
 }
 
-func topHandler(w http.ResponseWriter, r *http.Request) {
+func topHandler(w http.ResponseWriter, r *http.Request) error {
 	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
+		return err
 	}
 
-	keywords := getKeywordsByDesc()
-
-	perPage := 10
-	p := r.URL.Query().Get("page")
-	if p == "" {
-		p = "1"
+	page, perPage, err := parsePaging(r, 10, 0)
+	if err != nil {
+		return err
 	}
-	page, _ := strconv.Atoi(p)
 
 	rows, err := db.Query(
-		"SELECT * FROM entry ORDER BY updated_at DESC LIMIT ? OFFSET ?",
+		"SELECT "+entryColumns+" FROM entry ORDER BY updated_at DESC LIMIT ? OFFSET ?",
 		perPage, perPage*(page-1),
 	)
-
-	if err != nil && err != sql.ErrNoRows {
-		panicIf(err)
+	if err != nil {
+		return err
 	}
 	entries := make([]*Entry, 0, 10)
 	for rows.Next() {
-		e := Entry{}
-		err := rows.Scan(&e.ID, &e.AuthorID, &e.Keyword, &e.Description, &e.UpdatedAt, &e.CreatedAt, &e.KeywordLength)
-		panicIf(err)
-		html, err := getHTMLOfEntryfromRedis(e.Keyword)
-		if err == redis.ErrNil {
-			html = htmlify(w, r, e.Description, keywords)
-			err = setHTMLOfEntryToRedis(e.Keyword, html)
-			panicIf(err)
-		}
-		panicIf(err)
-		e.Html = html
-		// e.Stars = loadStars(e.Keyword)
-		stars := loadStarsFromCache(e.Keyword)
-		if len(stars) <= 0 {
-			e.Stars = loadStars(e.Keyword)
-		} else {
-			e.Stars = stars
+		e, err := scanEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
 		}
 		entries = append(entries, &e)
 	}
-
 	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Html, err = getHTMLOfEntry(*e); err != nil {
+			return err
+		}
+		if e.Stars, err = loadStars(e.Keyword); err != nil {
+			return err
+		}
+	}
 
 	// var totalEntries int
 	// row := db.QueryRow(`SELECT COUNT(*) FROM entry`)
 	// err = row.Scan(&totalEntries)
 	// if err != nil && err != sql.ErrNoRows {
-	// 	panicIf(err)
+	// 	return err
 	// }
 	totalEntries, err := getEntryNumFromRedis()
 	if err != nil {
-		panicIf(err)
+		return err
 	}
 
 	lastPage := int(math.Ceil(float64(totalEntries) / float64(perPage)))
@@ -200,62 +233,133 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 	}{
 		r.Context(), entries, page, lastPage, pages,
 	})
+	return nil
 }
 
-func robotsHandler(w http.ResponseWriter, r *http.Request) {
-	notFound(w)
+func robotsHandler(w http.ResponseWriter, r *http.Request) error {
+	return &NotFoundError{}
 }
 
-func keywordPostHandler(w http.ResponseWriter, r *http.Request) {
-	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
-	}
-	if err := authenticate(w, r); err != nil {
-		forbidden(w)
-		return
+func keywordPostHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
 	}
 
 	keyword := r.FormValue("keyword")
 	if keyword == "" {
-		badRequest(w)
-		return
+		return &ValidationError{"keyword is required"}
 	}
-	userID := getContext(r, "user_id").(int)
 	description := r.FormValue("description")
 
-	if isSpamContents(description) || isSpamContents(keyword) {
-		http.Error(w, "SPAM!", http.StatusBadRequest)
-		return
+	spam, err := isSpamContents(description, keyword)
+	if err != nil {
+		return err
+	}
+	if spam {
+		// 捨てずに管理者の確認を待つ
+		if err := queuePendingEntry(currentUser(r), keyword, description); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/pending", http.StatusFound)
+		return nil
+	}
+
+	if err := postEntry(currentUser(r), keyword, description); err != nil {
+		return err
 	}
 
-	tx, err := db.Begin()
-	panicIf(err)
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
 
-	_, err = db.Exec(`
+// postEntry はエントリを作成または更新する
+func postEntry(user User, keyword, description string) error {
+	var added bool
+	err := runInTx(func(u *unitOfWork) error {
+		var err error
+		added, err = postEntryInTx(u, user, user.ID, keyword, description)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return afterPostEntry(keyword, description, added)
+}
+
+// postEntryInTx は u のトランザクションでエントリを書き込む。キーワードが新しく増えたら true を返す。
+// 書き込めるかは actor の権限で確かめ、新しいエントリと版の作者は authorID にする。
+// コミットしたあとで afterPostEntry を呼ぶ
+func postEntryInTx(u *unitOfWork, actor User, authorID int, keyword, description string) (bool, error) {
+	if err := authorizeEntry(u.Tx, actor, keyword); err != nil {
+		return false, err
+	}
+	// 既存のエントリを管理者が編集しても作者は変えない
+	res, err := u.Tx.Exec(`
 		INSERT INTO entry (author_id, keyword, description, created_at, updated_at)
 		VALUES (?, ?, ?, NOW(), NOW())
 		ON DUPLICATE KEY UPDATE
-		author_id = ?, keyword = ?, description = ?, updated_at = NOW()
-	`, userID, keyword, description, userID, keyword, description)
+		keyword = ?, description = ?, updated_at = NOW()
+	`, authorID, keyword, description, keyword, description)
+	if err != nil {
+		return false, err
+	}
+	// ON DUPLICATE KEY UPDATE の RowsAffected は 挿入なら 1、更新なら 2、変更なしなら 0
+	n, err := res.RowsAffected()
 	if err != nil {
-		tx.Rollback()
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if err := insertRevision(u.Tx, authorID, keyword, description); err != nil {
+		return false, err
+	}
+	if n == 1 {
+		if err := addEntryNum(u, 1); err != nil {
+			return false, err
+		}
+	}
+	var added bool
+	err = u.Do(func() error {
+		added = keywordIdx.Add(keyword)
+		return nil
+	}, func() error {
+		if added {
+			keywordIdx.Remove(keyword)
+		}
+		return nil
+	})
+	return added, err
+}
+
+// afterPostEntry はコミットしたエントリを検索や補完、リンクに反映する
+func afterPostEntry(keyword, description string, added bool) error {
+	searchIdx.Put(keyword, description)
+	if err := updateSuggestion(keyword); err != nil {
+		return err
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
-		panicIf(err)
-	} else {
-		incEntryNum()
-		// flushAllHTML()
+	if err := setEntryLinks(keyword, linksOf(description)); err != nil {
+		return err
 	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	affected := []string{keyword}
+	if added {
+		// 新しいキーワードを含むエントリはリンク先が変わる
+		containing, err := getKeywordsOfEntriesContaining(keyword)
+		if err != nil {
+			return err
+		}
+		if err := relinkEntries(containing); err != nil {
+			return err
+		}
+		affected = append(affected, containing...)
+	}
+	return invalidateHTMLOfEntries(affected)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func loginHandler(w http.ResponseWriter, r *http.Request) error {
 	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
+		return err
 	}
 
 	re.HTML(w, http.StatusOK, "authenticate", struct {
@@ -264,35 +368,84 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}{
 		r.Context(), "login",
 	})
+	return nil
 }
 
-func loginPostHandler(w http.ResponseWriter, r *http.Request) {
+func loginPostHandler(w http.ResponseWriter, r *http.Request) error {
 	name := r.FormValue("name")
-	row := db.QueryRow(`SELECT * FROM user WHERE name = ?`, name)
+	row := db.QueryRow(`SELECT id, name, salt, password, created_at FROM user WHERE name = ?`, name)
 	user := User{}
 	err := row.Scan(&user.ID, &user.Name, &user.Salt, &user.Password, &user.CreatedAt)
-	if err == sql.ErrNoRows || user.Password != fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+r.FormValue("password")))) {
-		forbidden(w)
-		return
+	password := r.FormValue("password")
+	if err == sql.ErrNoRows {
+		// ユーザーが存在するかどうかを応答時間から推測されないように同じだけハッシュを計算する
+		hashPassword(password)
+		return errLoginFailed
+	}
+	if err != nil {
+		return err
+	}
+	ok, needsRehash, err := verifyPassword(user, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errLoginFailed
+	}
+	if needsRehash {
+		if err := rehashPassword(user.ID, password); err != nil {
+			log.Printf("failed to rehash password of user %d: %s", user.ID, err)
+		}
+	}
+	session, err := renewSession(w, r)
+	if err != nil {
+		return err
 	}
-	panicIf(err)
-	session := getSession(w, r)
 	session.Values["user_id"] = user.ID
-	session.Save(r, w)
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
-	session.Options = &sessions.Options{MaxAge: -1}
-	session.Save(r, w)
+func logoutHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := expireSession(w, r); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func registerHandler(w http.ResponseWriter, r *http.Request) {
+// logoutAllHandler はそのユーザーの全てのセッションを無効にする。
+// クッキーストアではサーバー側で無効にできないので、今のセッションだけログアウトする
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
+	}
+	if rv, ok := store.(sessionRevoker); ok {
+		if err := rv.RevokeUserSessions(getContext(r, "user_id").(int)); err != nil {
+			return err
+		}
+	}
+	if err := expireSession(w, r); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func expireSession(w http.ResponseWriter, r *http.Request) error {
+	session := getSession(w, r)
+	opts := *session.Options
+	opts.MaxAge = -1
+	session.Options = &opts
+	return session.Save(r, w)
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) error {
 	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
+		return err
 	}
 
 	re.HTML(w, http.StatusOK, "authenticate", struct {
@@ -301,30 +454,55 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}{
 		r.Context(), "register",
 	})
+	return nil
 }
 
-func registerPostHandler(w http.ResponseWriter, r *http.Request) {
+func registerPostHandler(w http.ResponseWriter, r *http.Request) error {
 	name := r.FormValue("name")
 	pw := r.FormValue("password")
 	if name == "" || pw == "" {
-		badRequest(w)
-		return
+		return &ValidationError{"name and password are required"}
+	}
+	userID, err := register(name, pw)
+	if isDuplicateEntry(err) {
+		return &ConflictError{"The name is already taken."}
+	}
+	if err != nil {
+		return err
+	}
+	session, err := renewSession(w, r)
+	if err != nil {
+		return err
 	}
-	userID := register(name, pw)
-	session := getSession(w, r)
 	session.Values["user_id"] = userID
-	session.Save(r, w)
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func register(user string, pass string) (int64, error) {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`INSERT INTO user (name, salt, password, created_at) VALUES (?, '', ?, NOW())`,
+		user, hash)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
 }
 
-func register(user string, pass string) int64 {
-	salt, err := strrand.RandomString(`....................`)
-	panicIf(err)
-	res, err := db.Exec(`INSERT INTO user (name, salt, password, created_at) VALUES (?, ?, ?, NOW())`,
-		user, salt, fmt.Sprintf("%x", sha1.Sum([]byte(salt+pass))))
-	panicIf(err)
-	lastInsertID, _ := res.LastInsertId()
-	return lastInsertID
+// rehashPassword は現在のアルゴリズムでパスワードを保存し直す
+func rehashPassword(userID int, pass string) error {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE user SET salt = '', password = ? WHERE id = ?`, hash, userID)
+	return err
 }
 
 func initEntries() error {
@@ -332,157 +510,205 @@ func initEntries() error {
 	return err
 }
 
-func getEntryByKeyword(kw string) (Entry, error) {
-	row := db.QueryRow(`SELECT * FROM entry WHERE keyword = ?`, kw)
+const entryColumns = "id, author_id, keyword, description, updated_at, created_at, keyword_length, protected"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row rowScanner) (Entry, error) {
 	e := Entry{}
-	err := row.Scan(&e.ID, &e.AuthorID, &e.Keyword, &e.Description, &e.UpdatedAt, &e.CreatedAt, &e.KeywordLength)
+	err := row.Scan(&e.ID, &e.AuthorID, &e.Keyword, &e.Description, &e.UpdatedAt, &e.CreatedAt, &e.KeywordLength, &e.Protected)
 	return e, err
 }
 
-func keywordByKeywordHandler(w http.ResponseWriter, r *http.Request) {
+func getEntryByKeyword(kw string) (Entry, error) {
+	return scanEntry(db.QueryRow(`SELECT `+entryColumns+` FROM entry WHERE keyword = ?`, kw))
+}
+
+func keywordByKeywordHandler(w http.ResponseWriter, r *http.Request) error {
 	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
+		return err
 	}
 
 	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
 
 	e, err := getEntryByKeyword(keyword)
 	if err == sql.ErrNoRows {
-		notFound(w)
-		return
+		return &NotFoundError{"keyword not found"}
+	}
+	if err != nil {
+		return err
 	}
 
-	keywords := getKeywordsByDesc()
-	html, err := getHTMLOfEntryfromRedis(e.Keyword)
-	if err == redis.ErrNil {
-		html = htmlify(w, r, e.Description, keywords)
-		err = setHTMLOfEntryToRedis(e.Keyword, html)
-		panicIf(err)
+	if e.Html, err = getHTMLOfEntry(e); err != nil {
+		return err
+	}
+	if e.Stars, err = loadStars(e.Keyword); err != nil {
+		return err
+	}
+	backlinks, err := getBacklinks(e.Keyword)
+	if err != nil {
+		return err
+	}
+	more := len(backlinks) > keywordBacklinksPreview
+	if more {
+		backlinks = backlinks[:keywordBacklinksPreview]
 	}
-	panicIf(err)
-	e.Html = html
-	e.Stars = loadStars(e.Keyword)
 
 	re.HTML(w, http.StatusOK, "keyword", struct {
-		Context context.Context
-		Entry   Entry
+		Context       context.Context
+		Entry         Entry
+		Backlinks     []string
+		MoreBacklinks bool
 	}{
-		r.Context(), e,
+		r.Context(), e, backlinks, more,
 	})
+	return nil
 }
 
-func keywordByKeywordDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if err := setName(w, r); err != nil {
-		forbidden(w)
-		return
-	}
-	if err := authenticate(w, r); err != nil {
-		forbidden(w)
-		return
+func keywordByKeywordDeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
 	}
 
-	keyword := mux.Vars(r)["keyword"]
+	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
 	if keyword == "" {
-		badRequest(w)
-		return
+		return &ValidationError{"keyword is required"}
 	}
 	if r.FormValue("delete") == "" {
-		badRequest(w)
-		return
+		return &ValidationError{"delete is required"}
 	}
-	row := db.QueryRow(`SELECT * FROM entry WHERE keyword = ?`, keyword)
-	e := Entry{}
-	err := row.Scan(&e.ID, &e.AuthorID, &e.Keyword, &e.Description, &e.UpdatedAt, &e.CreatedAt, &e.KeywordLength)
+	_, err := getEntryByKeyword(keyword)
 	if err == sql.ErrNoRows {
-		notFound(w)
-		return
+		return &NotFoundError{"keyword not found"}
 	}
-	tx, err := db.Begin()
-	panicIf(err)
-
-	_, err = db.Exec(`DELETE FROM entry WHERE keyword = ?`, keyword)
 	if err != nil {
-		tx.Rollback()
-		panicIf(err)
+		return err
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
-		panicIf(err)
-	} else {
-		decEntryNum()
-		// flushAllHTML()
-		updateReplacerWithDelete(keyword)
-
+	err = deleteEntry(currentUser(r), keyword)
+	if err == errEntryForbidden {
+		return &ForbiddenError{"Only the author or an administrator can delete this keyword."}
+	}
+	if err != nil {
+		return err
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func initReplacer() {
-
-	keywords := getKeywordsByDesc()
-	for _, kw := range keywords {
-		kw = regexp.QuoteMeta(kw)
-		kw2sha[kw] = "isuda_" + fmt.Sprintf("%x", sha1.Sum([]byte(kw)))
-		keywordPairList = append(keywordPairList, kw)
-		keywordPairList = append(keywordPairList, kw2sha[kw])
-	}
-}
-
-func removePair(strs []string, search string) []string {
-	result := []string{}
-	count := -1
-	for i, str := range strs {
-		if str == search {
-			count = i + 1
+// deleteEntry はエントリを削除する
+func deleteEntry(user User, keyword string) error {
+	err := runInTx(func(u *unitOfWork) error {
+		if err := authorizeEntry(u.Tx, user, keyword); err != nil {
+			return err
+		}
+		res, err := u.Tx.Exec(`DELETE FROM entry WHERE keyword = ?`, keyword)
+		if err != nil {
+			return err
 		}
-		if str != search || i != count {
-			result = append(result, str)
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
 		}
+		if n > 0 {
+			if err := addEntryNum(u, -n); err != nil {
+				return err
+			}
+		}
+		var removed bool
+		return u.Do(func() error {
+			removed = keywordIdx.Remove(keyword)
+			return nil
+		}, func() error {
+			if removed {
+				keywordIdx.Add(keyword)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	searchIdx.Remove(keyword)
+	if err := removeSuggestion(keyword); err != nil {
+		return err
 	}
-	return result
-}
 
-func updateReplacerWithPost(keyword string) {
+	r := NewRedisfulFromPool(redisPool)
+	linking, err := getEntriesLinkingTo(r, keyword)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := removeEntryLinks(keyword); err != nil {
+		return err
+	}
+	// keyword にリンクしていたエントリは別の短いキーワードにリンクするかもしれない
+	if err := relinkEntries(linking); err != nil {
+		return err
+	}
+	return invalidateHTMLOfEntries(append(linking, keyword))
+}
 
+func initKeywordIndex() error {
+	kws, err := getKeywordsByDesc()
+	if err != nil {
+		return err
+	}
+	keywordIdx.Reset(kws)
+	return nil
 }
 
-func updateReplacerWithDelete(keyword string) {
-	keywordPairList = removePair(keywordPairList, keyword)
-	delete(kw2sha, keyword)
+// getHTMLOfEntry はキャッシュされた HTML を返す。なければ htmlify してキャッシュする
+func getHTMLOfEntry(e Entry) (string, error) {
+	return getOrRenderHTMLOfEntry(e.Keyword, func() (string, error) {
+		html, links := htmlify(e.Description)
+		// HTML より先にリンク先を記録しておかないと無効化から漏れる
+		if err := setEntryLinks(e.Keyword, links); err != nil {
+			return "", err
+		}
+		return html, nil
+	})
 }
 
-func htmlify(w http.ResponseWriter, r *http.Request, content string, keywords []string) string {
+// htmlify は content 中のキーワードをリンクにした HTML と、リンクしたキーワードを返す。
+// 結果は Redis にキャッシュされるので、リンクはリクエストのホストではなく
+// canonicalOrigin (未設定ならルートからの相対パス) で組み立てる
+func htmlify(content string) (string, []string) {
 	if content == "" {
-		return ""
-	}
-	rs := strings.NewReplacer(keywordPairList...)
-	content = rs.Replace(content)
-	content = html.EscapeString(content)
-	for kw, hash := range kw2sha {
-		u, err := r.URL.Parse(baseUrl.String() + "/keyword/" + pathURIEscape(kw))
-		panicIf(err)
-		link := fmt.Sprintf("<a href=\"%s\">%s</a>", u, html.EscapeString(kw))
-		content = strings.Replace(content, hash, link, -1)
-	}
+		return "", nil
+	}
+	var buf strings.Builder
+	var links []string
+	linked := make(map[string]struct{})
+	last := 0
+	keywordIdx.Snapshot().Each(content, func(start, end int) {
+		kw := content[start:end]
+		u, err := url.Parse(keywordLinkOrigin() + "/keyword/" + pathURIEscape(kw))
+		if err != nil {
+			// リンクにできないキーワードは地の文として出す
+			return
+		}
+		if _, ok := linked[kw]; !ok {
+			linked[kw] = struct{}{}
+			links = append(links, kw)
+		}
+		buf.WriteString(html.EscapeString(content[last:start]))
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>", u, html.EscapeString(kw))
+		last = end
+	})
+	buf.WriteString(html.EscapeString(content[last:]))
 
-	return strings.Replace(content, "\n", "<br />\n", -1)
+	return strings.Replace(buf.String(), "\n", "<br />\n", -1), links
 }
 
-func isSpamContents(content string) bool {
-	v := url.Values{}
-	v.Set("content", content)
-	resp, err := http.PostForm(isupamEndpoint, v)
-	panicIf(err)
-	defer resp.Body.Close()
-
-	var data struct {
-		Valid bool `json:valid`
+func keywordLinkOrigin() string {
+	if canonicalOrigin == nil {
+		return ""
 	}
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	panicIf(err)
-	return !data.Valid
+	return canonicalOrigin.String()
 }
 
 func getContext(r *http.Request, key interface{}) interface{} {
@@ -536,23 +762,106 @@ func main() {
 	db.Exec("SET SESSION sql_mode='TRADITIONAL,NO_AUTO_VALUE_ON_ZERO,ONLY_FULL_GROUP_BY'")
 	db.Exec("SET NAMES utf8mb4")
 
+	if err := initKeywordIndex(); err != nil {
+		log.Fatalf("Failed to build the keyword index: %s.", err.Error())
+	}
+	if err := initSearchIndex(); err != nil {
+		log.Fatalf("Failed to build the search index: %s.", err.Error())
+	}
+	if err := rebuildEntryLinks(); err != nil {
+		log.Fatalf("Failed to build entry links: %s.", err.Error())
+	}
+	if err := rebuildSuggestIndex(); err != nil {
+		log.Fatalf("Failed to build keyword suggestions: %s.", err.Error())
+	}
+	if err := spamVerdicts.Load(); err != nil {
+		log.Fatalf("Failed to load spam verdicts: %s.", err.Error())
+	}
+	if err := warmStarStore(); err != nil {
+		log.Fatalf("Failed to load stars into Redis: %s.", err.Error())
+	}
+
+	switch p := os.Getenv("ISUDA_STAR_POLICY"); p {
+	case "":
+	case starPolicyUnique, starPolicyRateLimit, starPolicyNone:
+		starPolicy = p
+	default:
+		log.Fatalf("Invalid ISUDA_STAR_POLICY: %q", p)
+	}
+	if v := os.Getenv("ISUDA_STAR_RATE_LIMIT"); v != "" {
+		starRateLimit, err = strconv.Atoi(v)
+		if err != nil || starRateLimit < 1 {
+			log.Fatalf("Invalid ISUDA_STAR_RATE_LIMIT: %q", v)
+		}
+	}
+	if v := os.Getenv("ISUDA_STAR_RATE_WINDOW"); v != "" {
+		starRateWindow, err = time.ParseDuration(v)
+		if err != nil || starRateWindow <= 0 {
+			log.Fatalf("Invalid ISUDA_STAR_RATE_WINDOW: %q", v)
+		}
+	}
+
+	reconcileInterval := 5 * time.Minute
+	if v := os.Getenv("ISUDA_ENTRY_RECONCILE_INTERVAL"); v != "" {
+		reconcileInterval, err = time.ParseDuration(v)
+		if err != nil || reconcileInterval < 0 {
+			log.Fatalf("Invalid ISUDA_ENTRY_RECONCILE_INTERVAL: %q", v)
+		}
+	}
+	if reconcileInterval > 0 {
+		startEntryNumReconciler(reconcileInterval)
+	}
+
+	debugAddr := os.Getenv("ISUDA_DEBUG_ADDR")
+	if debugAddr == "" {
+		debugAddr = "127.0.0.1:6060"
+	}
+	if debugAddr != "off" {
+		startDebugServer(debugAddr)
+	}
+
 	isutarEndpoint = os.Getenv("ISUTAR_ORIGIN")
 	if isutarEndpoint == "" {
 		isutarEndpoint = "http://localhost:5001"
 	}
+	if origin := os.Getenv("ISUDA_ORIGIN"); origin != "" {
+		canonicalOrigin, err = url.Parse(strings.TrimRight(origin, "/"))
+		if err != nil || canonicalOrigin.Scheme == "" || canonicalOrigin.Host == "" {
+			log.Fatalf("Invalid ISUDA_ORIGIN: %q", origin)
+		}
+	}
+
 	isupamEndpoint = os.Getenv("ISUPAM_ORIGIN")
 	if isupamEndpoint == "" {
 		isupamEndpoint = "http://localhost:5050"
 	}
+	var ngWords *localSpamFilter
+	spamVerdicts.next, ngWords, err = newSpamCheckerFromEnv(isupamEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to configure the spam checker: %s.", err.Error())
+	}
+	spamChecker = spamVerdicts
+	if ngWords != nil {
+		ngWords.WatchReload()
+	}
 
-	store = sessions.NewCookieStore([]byte(sessionSecret))
+	if name := os.Getenv("ISUDA_PASSWORD_HASHER"); name != "" {
+		if err := setCurrentPasswordHasher(name); err != nil {
+			log.Fatalf("Invalid ISUDA_PASSWORD_HASHER: %q", name)
+		}
+	}
+
+	store, csrfCookies, err = newSessionStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure sessions: %s.", err.Error())
+	}
 
 	re = render.New(render.Options{
 		Directory: "views",
 		Funcs: []template.FuncMap{
 			{
-				"url_for": func(path string) string {
-					return baseUrl.String() + path
+				"url_for": func(ctx context.Context, path string) string {
+					return getBaseURL(ctx).String() + path
 				},
 				"title": func(s string) string {
 					return strings.Title(s)
@@ -560,6 +869,10 @@ func main() {
 				"raw": func(text string) template.HTML {
 					return template.HTML(text)
 				},
+				"csrf_token": func(ctx context.Context) string {
+					token, _ := ctx.Value(csrfTokenKey).(string)
+					return token
+				},
 				"add": func(a, b int) int { return a + b },
 				"sub": func(a, b int) int { return a - b },
 				"entry_with_ctx": func(entry Entry, ctx context.Context) *EntryWithCtx {
@@ -575,23 +888,45 @@ func main() {
 	r.HandleFunc("/initialize", myHandler(initializeHandler)).Methods("GET")
 	r.HandleFunc("/robots.txt", myHandler(robotsHandler))
 	r.HandleFunc("/keyword", myHandler(keywordPostHandler)).Methods("POST")
+	r.HandleFunc("/search", myHandler(searchHandler)).Methods("GET")
+	r.HandleFunc("/keywords/suggest", apiHandler(keywordsSuggestHandler)).Methods("GET")
+	r.HandleFunc("/pending", myHandler(pendingHandler)).Methods("GET")
+	r.HandleFunc("/admin/moderation", myHandler(moderationHandler)).Methods("GET")
+	r.HandleFunc("/admin/moderation/{id:[0-9]+}/{action:approve|reject}", myHandler(moderationReviewHandler)).Methods("POST")
 
 	l := r.PathPrefix("/login").Subrouter()
 	l.Methods("GET").HandlerFunc(myHandler(loginHandler))
 	l.Methods("POST").HandlerFunc(myHandler(loginPostHandler))
-	r.HandleFunc("/logout", myHandler(logoutHandler))
+	r.HandleFunc("/logout", myHandler(logoutHandler)).Methods("POST")
+	r.HandleFunc("/logout/all", myHandler(logoutAllHandler)).Methods("POST")
 
 	g := r.PathPrefix("/register").Subrouter()
 	g.Methods("GET").HandlerFunc(myHandler(registerHandler))
 	g.Methods("POST").HandlerFunc(myHandler(registerPostHandler))
 
 	k := r.PathPrefix("/keyword/{keyword}").Subrouter()
+	k.Path("/protect").Methods("POST").HandlerFunc(myHandler(keywordProtectHandler))
+	k.Path("/history").Methods("GET").HandlerFunc(myHandler(keywordHistoryHandler))
+	k.Path("/diff").Methods("GET").HandlerFunc(myHandler(keywordDiffHandler))
+	k.Path("/backlinks").Methods("GET").HandlerFunc(myHandler(keywordBacklinksHandler))
+	k.Path("/revisions/{revision:[0-9]+}").Methods("GET").HandlerFunc(myHandler(keywordRevisionHandler))
+	k.Path("/revisions/{revision:[0-9]+}/revert").Methods("POST").HandlerFunc(myHandler(keywordRevertHandler))
 	k.Methods("GET").HandlerFunc(myHandler(keywordByKeywordHandler))
 	k.Methods("POST").HandlerFunc(myHandler(keywordByKeywordDeleteHandler))
 
 	s := r.PathPrefix("/stars").Subrouter()
-	// s.Methods("GET").HandlerFunc(myHandler(starsHandler))
-	s.Methods("POST").HandlerFunc(myHandler(starsPostHandler))
+	s.Methods("GET").HandlerFunc(apiHandler(starsHandler))
+	s.Methods("POST").HandlerFunc(apiHandler(starsPostHandler))
+	s.Methods("DELETE").HandlerFunc(apiHandler(starsDeleteHandler))
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/csrf_token", apiHandler(csrfTokenHandler)).Methods("GET")
+	api.HandleFunc("/entries", apiHandler(apiEntriesHandler)).Methods("GET")
+	api.HandleFunc("/entries", apiHandler(apiEntryPutHandler)).Methods("POST")
+	api.HandleFunc("/entries/{keyword}", apiHandler(apiEntryHandler)).Methods("GET")
+	api.HandleFunc("/entries/{keyword}", apiHandler(apiEntryPutHandler)).Methods("PUT")
+	api.HandleFunc("/entries/{keyword}", apiHandler(apiEntryDeleteHandler)).Methods("DELETE")
+	api.HandleFunc("/search", apiHandler(apiSearchHandler)).Methods("GET")
 
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
 	log.Fatal(http.ListenAndServe(":5000", r))
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// keywordMergeDelay は追加や削除のあと、差分をまとめたオートマトンを作り直すまで待つ時間
+const keywordMergeDelay = time.Second
+
+// keywordBase はオートマトンを作ったキーワード集合。作ったあとは変更しない
+type keywordBase struct {
+	// 文字数の長い順、同じ長さなら辞書順
+	keywords []string
+	exists   map[string]struct{}
+
+	matcherOnce sync.Once
+	matcher     *ahoCorasick
+}
+
+func newKeywordBase(keywords []string, exists map[string]struct{}) *keywordBase {
+	return &keywordBase{
+		keywords: keywords,
+		exists:   exists,
+	}
+}
+
+// マッチャーは最初に使われたときに作る
+func (b *keywordBase) Matcher() *ahoCorasick {
+	b.matcherOnce.Do(func() {
+		b.matcher = newAhoCorasick(b.keywords)
+	})
+	return b.matcher
+}
+
+// keywordSnapshot はある時点のキーワード集合。base に added を足して removed を除いたもの。
+// added は base になく、removed は base にあるキーワードだけを持つ。作ったあとは変更しない
+type keywordSnapshot struct {
+	base    *keywordBase
+	added   map[string]struct{}
+	removed map[string]struct{}
+	// added だけのオートマトン。added は小さいのですぐに作る
+	addedMatcher *ahoCorasick
+}
+
+func newKeywordSnapshot(base *keywordBase, added, removed map[string]struct{}) *keywordSnapshot {
+	patterns := make([]string, 0, len(added))
+	for kw := range added {
+		patterns = append(patterns, kw)
+	}
+	return &keywordSnapshot{
+		base:         base,
+		added:        added,
+		removed:      removed,
+		addedMatcher: newAhoCorasick(patterns),
+	}
+}
+
+func (s *keywordSnapshot) Contains(kw string) bool {
+	if _, ok := s.added[kw]; ok {
+		return true
+	}
+	if _, ok := s.removed[kw]; ok {
+		return false
+	}
+	_, ok := s.base.exists[kw]
+	return ok
+}
+
+// Keywords は文字数の長い順、同じ長さなら辞書順のキーワードを返す
+func (s *keywordSnapshot) Keywords() []string {
+	if len(s.added) == 0 && len(s.removed) == 0 {
+		return s.base.keywords
+	}
+	keywords := make([]string, 0, len(s.base.keywords)+len(s.added))
+	for _, kw := range s.base.keywords {
+		if _, ok := s.removed[kw]; !ok {
+			keywords = append(keywords, kw)
+		}
+	}
+	for kw := range s.added {
+		keywords = append(keywords, kw)
+	}
+	sort.Slice(keywords, func(i, j int) bool { return keywordLess(keywords[i], keywords[j]) })
+	return keywords
+}
+
+// Each は content 中のキーワードを leftmost-longest で列挙する。
+// 差分があるときは両方のオートマトンのマッチを全部集め、削除されたものを除いてから選ぶ
+func (s *keywordSnapshot) Each(content string, fn func(start, end int)) {
+	if len(s.added) == 0 && len(s.removed) == 0 {
+		s.base.Matcher().each(content, fn)
+		return
+	}
+
+	var matches [][2]int
+	collect := func(start, end int) {
+		if _, ok := s.removed[content[start:end]]; !ok {
+			matches = append(matches, [2]int{start, end})
+		}
+	}
+	s.base.Matcher().eachMatch(content, collect)
+	s.addedMatcher.eachMatch(content, collect)
+	// 先に始まるもの、同じ位置から始まるなら長いものを選び、重なるものは捨てる
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i][0] != matches[j][0] {
+			return matches[i][0] < matches[j][0]
+		}
+		return matches[i][1] > matches[j][1]
+	})
+	last := 0
+	for _, m := range matches {
+		if m[0] < last {
+			continue
+		}
+		fn(m[0], m[1])
+		last = m[1]
+	}
+}
+
+func keywordLess(a, b string) bool {
+	la, lb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if la != lb {
+		return la > lb
+	}
+	return a < b
+}
+
+func copyKeywordSet(src map[string]struct{}, extra int) map[string]struct{} {
+	dst := make(map[string]struct{}, len(src)+extra)
+	for kw := range src {
+		dst[kw] = struct{}{}
+	}
+	return dst
+}
+
+// keywordIndex は htmlify でリンクにするキーワードの集合。
+// 読み込みは現在のスナップショットをそのまま使い、書き込みは新しいスナップショットを作って差し替える。
+//
+// 7000 ほどのキーワードのオートマトンを作るのは数十 ms かかるので、投稿や削除のたびには作らない。
+// 追加と削除は差分として持ち、差分だけのオートマトンと合わせて使う。差分があるときの Each は
+// 重なるマッチも全部集めて並べるので少し遅い。keywordMergeDelay のあとにまとめて作り直し、
+// できあがるまでは今のスナップショットを使い続ける
+type keywordIndex struct {
+	// 書き込み同士の排他
+	mu       sync.Mutex
+	snapshot atomic.Value
+	// 作り直しを予約しているか。mu で守る
+	mergeScheduled bool
+}
+
+func newKeywordIndex() *keywordIndex {
+	idx := &keywordIndex{}
+	idx.snapshot.Store(newKeywordSnapshot(newKeywordBase(nil, map[string]struct{}{}), nil, nil))
+	return idx
+}
+
+func (idx *keywordIndex) Snapshot() *keywordSnapshot {
+	return idx.snapshot.Load().(*keywordSnapshot)
+}
+
+// Reset はキーワード集合を丸ごと入れ替える。何度呼んでも重複しない
+func (idx *keywordIndex) Reset(keywords []string) {
+	sorted := make([]string, 0, len(keywords))
+	exists := make(map[string]struct{}, len(keywords))
+	for _, kw := range keywords {
+		if _, ok := exists[kw]; ok || kw == "" {
+			continue
+		}
+		exists[kw] = struct{}{}
+		sorted = append(sorted, kw)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return keywordLess(sorted[i], sorted[j]) })
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.snapshot.Store(newKeywordSnapshot(newKeywordBase(sorted, exists), nil, nil))
+}
+
+// Add はキーワードを追加する。新しく追加された場合は true を返す
+func (idx *keywordIndex) Add(kw string) bool {
+	if kw == "" {
+		return false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	cur := idx.Snapshot()
+	if cur.Contains(kw) {
+		return false
+	}
+	added, removed := cur.added, cur.removed
+	if _, ok := removed[kw]; ok {
+		removed = copyKeywordSet(removed, 0)
+		delete(removed, kw)
+	} else {
+		added = copyKeywordSet(added, 1)
+		added[kw] = struct{}{}
+	}
+	idx.snapshot.Store(newKeywordSnapshot(cur.base, added, removed))
+	idx.scheduleMerge()
+	return true
+}
+
+// Remove はキーワードを削除する。存在しなかった場合は false を返す
+func (idx *keywordIndex) Remove(kw string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	cur := idx.Snapshot()
+	if !cur.Contains(kw) {
+		return false
+	}
+	added, removed := cur.added, cur.removed
+	if _, ok := added[kw]; ok {
+		added = copyKeywordSet(added, 0)
+		delete(added, kw)
+	} else {
+		removed = copyKeywordSet(removed, 1)
+		removed[kw] = struct{}{}
+	}
+	idx.snapshot.Store(newKeywordSnapshot(cur.base, added, removed))
+	idx.scheduleMerge()
+	return true
+}
+
+func (idx *keywordIndex) Contains(kw string) bool {
+	return idx.Snapshot().Contains(kw)
+}
+
+// scheduleMerge は keywordMergeDelay のあとに merge を呼ぶ。mu を持って呼ぶ
+func (idx *keywordIndex) scheduleMerge() {
+	if idx.mergeScheduled {
+		return
+	}
+	idx.mergeScheduled = true
+	time.AfterFunc(keywordMergeDelay, idx.merge)
+}
+
+// merge は差分を取り込んだオートマトンを作り、作り終えてから差し替える。
+// 作っている間の追加や削除は新しいスナップショットの差分に残す
+func (idx *keywordIndex) merge() {
+	idx.mu.Lock()
+	idx.mergeScheduled = false
+	from := idx.Snapshot()
+	idx.mu.Unlock()
+
+	keywords := from.Keywords()
+	exists := make(map[string]struct{}, len(keywords))
+	for _, kw := range keywords {
+		exists[kw] = struct{}{}
+	}
+	base := newKeywordBase(keywords, exists)
+	base.Matcher()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	cur := idx.Snapshot()
+	if cur.base != from.base {
+		// Reset されたのでこの結果は古い
+		return
+	}
+	added, removed := map[string]struct{}{}, map[string]struct{}{}
+	for _, delta := range []map[string]struct{}{from.added, from.removed, cur.added, cur.removed} {
+		for kw := range delta {
+			_, inBase := base.exists[kw]
+			if want := cur.Contains(kw); want && !inBase {
+				added[kw] = struct{}{}
+			} else if !want && inBase {
+				removed[kw] = struct{}{}
+			}
+		}
+	}
+	idx.snapshot.Store(newKeywordSnapshot(base, added, removed))
+	if len(added) > 0 || len(removed) > 0 {
+		idx.scheduleMerge()
+	}
+}
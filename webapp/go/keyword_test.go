@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKeywordIndexAddRemove(t *testing.T) {
+	idx := newKeywordIndex()
+	idx.Reset([]string{"b", "abc", "ab", "b", ""})
+	if got := idx.Snapshot().Keywords(); strings.Join(got, ",") != "abc,ab,b" {
+		t.Fatalf("keywords = %q", got)
+	}
+	if !idx.Add("xy") || idx.Add("xy") || idx.Add("") {
+		t.Fatal("Add should report only new keywords")
+	}
+	if got := idx.Snapshot().Keywords(); strings.Join(got, ",") != "abc,ab,xy,b" {
+		t.Fatalf("keywords = %q", got)
+	}
+	if !idx.Remove("ab") || idx.Remove("ab") {
+		t.Fatal("Remove should report only existing keywords")
+	}
+	if idx.Contains("ab") || !idx.Contains("abc") {
+		t.Fatal("Contains does not follow Remove")
+	}
+}
+
+// eachString は Each の結果を replaceWithReplacer と同じ形にする
+func eachString(s *keywordSnapshot, text string) string {
+	var buf strings.Builder
+	last := 0
+	s.Each(text, func(start, end int) {
+		buf.WriteString(text[last:start])
+		buf.WriteString("<" + text[start:end] + ">")
+		last = end
+	})
+	buf.WriteString(text[last:])
+	return buf.String()
+}
+
+func TestKeywordIndexDeltaMatchesMerged(t *testing.T) {
+	idx := newKeywordIndex()
+	idx.Reset([]string{"abc", "ab", "b", "日本語", "日本"})
+	idx.Add("bcd")
+	idx.Add("本語を")
+	idx.Remove("abc")
+	idx.Remove("日本語")
+	idx.Add("日本語")
+
+	texts := []string{"abcde", "xabcabd", "日本語を話す日本人", "bcdbcd"}
+	want := make([]string, len(texts))
+	for i, text := range texts {
+		want[i] = replaceWithReplacer(idx.Snapshot().Keywords(), text)
+		if got := eachString(idx.Snapshot(), text); got != want[i] {
+			t.Errorf("before merge %q: got %q, want %q", text, got, want[i])
+		}
+	}
+
+	idx.merge()
+	s := idx.Snapshot()
+	if len(s.added) != 0 || len(s.removed) != 0 {
+		t.Fatalf("delta remains after merge: %v %v", s.added, s.removed)
+	}
+	for i, text := range texts {
+		if got := eachString(s, text); got != want[i] {
+			t.Errorf("after merge %q: got %q, want %q", text, got, want[i])
+		}
+	}
+}
+
+// go test -race で、投稿や削除と htmlify が同時に走っても壊れないことを確かめる
+func TestKeywordIndexConcurrentHTMLify(t *testing.T) {
+	saved := keywordIdx
+	defer func() { keywordIdx = saved }()
+	keywordIdx = newKeywordIndex()
+	keywordIdx.Reset([]string{"isucon", "isuda"})
+
+	const writers, readers, rounds = 4, 4, 200
+	content := "isucon と isuda と tmp-1 と tmp-2"
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				kw := "tmp-" + strconv.Itoa((w+i)%3)
+				keywordIdx.Add(kw)
+				keywordIdx.Remove(kw)
+			}
+		}(w)
+	}
+	errs := make(chan string, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				html, links := htmlify(content)
+				// 消されないキーワードはいつでもリンクになる
+				if !strings.Contains(html, `<a href="/keyword/isucon">isucon</a>`) ||
+					!strings.Contains(html, `<a href="/keyword/isuda">isuda</a>`) ||
+					len(links) < 2 {
+					errs <- html
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for html := range errs {
+		t.Errorf("stable keywords are not linked: %s", html)
+	}
+
+	for _, kw := range []string{"tmp-0", "tmp-1", "tmp-2"} {
+		if keywordIdx.Contains(kw) {
+			t.Errorf("%s should have been removed", kw)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unicode/utf8"
+)
+
+// =====================
+//	NG ワードによるスパム判定
+// =====================
+// NG ワードを 1 つでも含む content を spam とする。大文字小文字と全角英数字の違いは無視する。
+// NG ワードのファイルは拡張子で形式を決める
+//
+//	.json 文字列、文字列の配列、{"k": ...} か {"word": ...} のオブジェクトを並べたもの (ng.json の形式)
+//	それ以外 1 行に 1 つ。# で始まる行は無視する
+//
+// SIGHUP で読み直す。読み直しに失敗したら今のリストを使い続ける
+
+type ngWordList struct {
+	matcher *ahoCorasick
+	size    int
+}
+
+type localSpamFilter struct {
+	path string
+	list atomic.Value
+}
+
+func newLocalSpamFilter(path string) (*localSpamFilter, error) {
+	f := &localSpamFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *localSpamFilter) Reload() error {
+	words, err := loadNGWords(f.path)
+	if err != nil {
+		return err
+	}
+	patterns := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			patterns = append(patterns, string(normalizeRunes(w)))
+		}
+	}
+	f.list.Store(&ngWordList{
+		matcher: newAhoCorasick(patterns),
+		size:    len(patterns),
+	})
+	log.Printf("loaded %d NG words from %s", len(patterns), f.path)
+	return nil
+}
+
+func (f *localSpamFilter) IsSpam(content string) (bool, error) {
+	list := f.list.Load().(*ngWordList)
+	text := string(normalizeRunes(content))
+	return list.matcher.containsFunc(text, func(start, end int) bool {
+		return onWordBoundary(text, start, end)
+	}), nil
+}
+
+// onWordBoundary は text[start:end] の両端が英数字の語の途中で切れていないかを返す
+func onWordBoundary(text string, start, end int) bool {
+	first, _ := utf8.DecodeRuneInString(text[start:end])
+	if isASCIIWordRune(first) {
+		if r, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isASCIIWordRune(r) {
+			return false
+		}
+	}
+	last, _ := utf8.DecodeLastRuneInString(text[start:end])
+	if isASCIIWordRune(last) {
+		if r, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isASCIIWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIIWordRune(r rune) bool {
+	return r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// WatchReload は SIGHUP を受け取るたびに NG ワードを読み直す
+func (f *localSpamFilter) WatchReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := f.Reload(); err != nil {
+				log.Printf("Failed to reload NG words: %s", err)
+			}
+		}
+	}()
+}
+
+func loadNGWords(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return parseNGWordsJSON(data)
+	}
+	return parseNGWordsText(data)
+}
+
+func parseNGWordsText(data []byte) ([]string, error) {
+	var words []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, sc.Err()
+}
+
+func parseNGWordsJSON(data []byte) ([]string, error) {
+	var words []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return words, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ws, err := ngWordsOf(v)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, ws...)
+	}
+}
+
+func ngWordsOf(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var words []string
+		for _, e := range v {
+			ws, err := ngWordsOf(e)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, ws...)
+		}
+		return words, nil
+	case map[string]interface{}:
+		if w, ok := v["word"].(string); ok {
+			return []string{w}, nil
+		}
+		return nil, errors.New(`NG word object must have "word"`)
+	}
+	return nil, fmt.Errorf("unexpected NG word value: %v", v)
+}
+
+// spamChain は順に問い合わせ、どれかが spam と言えば spam とする。
+// 判定できないものがあっても、ほかが spam と言えば spam とする
+type spamChain []SpamChecker
+
+func (c spamChain) IsSpam(content string) (bool, error) {
+	var firstErr error
+	for _, checker := range c {
+		spam, err := checker.IsSpam(content)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if spam {
+			return true, nil
+		}
+	}
+	return false, firstErr
+}
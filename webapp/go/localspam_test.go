@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLocalSpamFilter(t *testing.T, name, data string) *localSpamFilter {
+	dir, err := ioutil.TempDir("", "ngwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newLocalSpamFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLocalSpamFilterWordBoundary(t *testing.T) {
+	f := newTestLocalSpamFilter(t, "ng.txt", "# comment\nAda\nFM-7\nスパム\n")
+	for content, want := range map[string]bool{
+		"I live in Canada": false,
+		"Adam":             false,
+		"Ada Lovelace":     true,
+		"言語は ada です":       true,
+		"ＡＤＡで書いた":          true,
+		"FM-77":            false,
+		"FM-7 のゲーム":        true,
+		"これはスパムです":         true,
+		"ふつうの文章":           false,
+		"Canada と ada の両方": true,
+	} {
+		spam, err := f.IsSpam(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spam != want {
+			t.Errorf("IsSpam(%q) = %v, want %v", content, spam, want)
+		}
+	}
+}
+
+func TestParseNGWordsJSON(t *testing.T) {
+	words, err := parseNGWordsJSON([]byte(`["a", "b"] "c" {"word": "d"}`))
+	if err != nil || len(words) != 4 {
+		t.Fatalf("got %q, %v", words, err)
+	}
+	// ng.json のようなスパムの例は NG ワードのリストとして読まない
+	if _, err := parseNGWordsJSON([]byte(`{"k": "音楽のジャンル一覧", "v": "..."}`)); err == nil {
+		t.Error(`objects with "k" should be rejected`)
+	}
+}
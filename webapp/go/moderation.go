@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// =====================
+//	モデレーション
+// =====================
+// spam と判定された投稿は捨てずに pending_entry に入れ、管理者が承認か却下をする。
+// 承認した content は以後 spam としない。却下した説明文は以後 spam とする。
+//
+// 判断は content ごとに覚え (大文字小文字、全角半角、空白の違いは無視する)、NG ワードのリストには足さない。
+// 1 つの投稿からどの語が NG かは決められず、語を取り出すとふつうの語で弾いてしまうため。
+// 書き換えたスパムは今までどおり NG ワードか isupam の判定にまかせる
+
+const (
+	pendingStatusPending  = "pending"
+	pendingStatusApproved = "approved"
+	pendingStatusRejected = "rejected"
+
+	moderationPerPage = 50
+)
+
+var (
+	errPendingEntryReviewed = errors.New("pending entry is already reviewed")
+	errModerationForbidden  = &ForbiddenError{"Only administrators can moderate posts."}
+)
+
+// spamVerdictList は管理者の判断を判定より優先する SpamChecker
+type spamVerdictList struct {
+	next SpamChecker
+
+	mu sync.RWMutex
+	// verdictHash(content) -> spam か
+	verdicts map[string]bool
+}
+
+var spamVerdicts = &spamVerdictList{verdicts: map[string]bool{}}
+
+func (l *spamVerdictList) IsSpam(content string) (bool, error) {
+	l.mu.RLock()
+	spam, ok := l.verdicts[verdictHash(content)]
+	l.mu.RUnlock()
+	if ok {
+		return spam, nil
+	}
+	return l.next.IsSpam(content)
+}
+
+// verdictHash は大文字小文字、全角半角、空白の違いを無視した content のハッシュ
+func verdictHash(content string) string {
+	var buf strings.Builder
+	for _, r := range normalizeRunes(content) {
+		if !unicode.IsSpace(r) {
+			buf.WriteRune(r)
+		}
+	}
+	return contentHash(buf.String())
+}
+
+func (l *spamVerdictList) Load() error {
+	rows, err := db.Query(`SELECT content_hash, spam FROM spam_verdict`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	verdicts := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		var spam bool
+		if err := rows.Scan(&hash, &spam); err != nil {
+			return err
+		}
+		verdicts[hash] = spam
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.verdicts = verdicts
+	l.mu.Unlock()
+	return nil
+}
+
+// Set は判断を保存する。トランザクションが失敗したらメモリ上の判断も元に戻す
+func (l *spamVerdictList) Set(u *unitOfWork, content string, spam bool) error {
+	hash := verdictHash(content)
+	_, err := u.Tx.Exec(`
+		INSERT INTO spam_verdict (content_hash, spam, created_at) VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE spam = ?, created_at = NOW()
+	`, hash, spam, spam)
+	if err != nil {
+		return err
+	}
+
+	var old, existed bool
+	return u.Do(func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		old, existed = l.verdicts[hash]
+		l.verdicts[hash] = spam
+		return nil
+	}, func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if existed {
+			l.verdicts[hash] = old
+		} else {
+			delete(l.verdicts, hash)
+		}
+		return nil
+	})
+}
+
+func initializeModeration() error {
+	for _, table := range []string{"pending_entry", "spam_verdict"} {
+		if _, err := db.Exec("TRUNCATE " + table); err != nil {
+			return err
+		}
+	}
+	return spamVerdicts.Load()
+}
+
+const pendingEntryColumns = "p.id, p.author_id, IFNULL(u.name, ''), p.keyword, p.description, p.status, p.created_at"
+
+func scanPendingEntry(row rowScanner) (PendingEntry, error) {
+	p := PendingEntry{}
+	err := row.Scan(&p.ID, &p.AuthorID, &p.AuthorName, &p.Keyword, &p.Description, &p.Status, &p.CreatedAt)
+	return p, err
+}
+
+func queryPendingEntries(query string, args ...interface{}) ([]*PendingEntry, error) {
+	rows, err := db.Query(`
+		SELECT `+pendingEntryColumns+`
+		FROM pending_entry p LEFT JOIN user u ON u.id = p.author_id
+		`+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*PendingEntry, 0)
+	for rows.Next() {
+		p, err := scanPendingEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &p)
+	}
+	return entries, rows.Err()
+}
+
+// queuePendingEntry は承認待ちに入れる。承認されても編集できない投稿は受け付けない
+func queuePendingEntry(user User, keyword, description string) error {
+	e, err := getEntryByKeyword(keyword)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && !canModifyEntry(user, e.AuthorID, e.Protected) {
+		return errEntryForbidden
+	}
+	_, err = db.Exec(`
+		INSERT INTO pending_entry (author_id, keyword, description, status, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, user.ID, keyword, description, pendingStatusPending)
+	return err
+}
+
+// reviewPendingEntry は承認待ちの投稿を status にして返す。承認待ちでなければ errPendingEntryReviewed
+func reviewPendingEntry(tx *sql.Tx, id int64, reviewer User, status string) (PendingEntry, error) {
+	p, err := scanPendingEntry(tx.QueryRow(`
+		SELECT `+pendingEntryColumns+`
+		FROM pending_entry p LEFT JOIN user u ON u.id = p.author_id
+		WHERE p.id = ? FOR UPDATE
+	`, id))
+	if err != nil {
+		return p, err
+	}
+	if p.Status != pendingStatusPending {
+		return p, errPendingEntryReviewed
+	}
+	_, err = tx.Exec(`
+		UPDATE pending_entry SET status = ?, reviewer_id = ?, reviewed_at = NOW() WHERE id = ?
+	`, status, reviewer.ID, id)
+	p.Status = status
+	return p, err
+}
+
+// approvePendingEntry は投稿者の名前で通常の投稿と同じように公開する。
+// 承認、判断の記録、公開は 1 つのトランザクションで行い、公開できなければどれも残さない
+func approvePendingEntry(id int64, reviewer User) error {
+	if !reviewer.IsAdmin {
+		return errEntryForbidden
+	}
+	var p PendingEntry
+	var added bool
+	err := runInTx(func(u *unitOfWork) error {
+		var err error
+		p, err = reviewPendingEntry(u.Tx, id, reviewer, pendingStatusApproved)
+		if err != nil {
+			return err
+		}
+		if err := spamVerdicts.Set(u, p.Description, false); err != nil {
+			return err
+		}
+		if err := spamVerdicts.Set(u, p.Keyword, false); err != nil {
+			return err
+		}
+		// 作者は投稿者のまま、権限は承認した管理者のものを使う
+		added, err = postEntryInTx(u, reviewer, p.AuthorID, p.Keyword, p.Description)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return afterPostEntry(p.Keyword, p.Description, added)
+}
+
+func rejectPendingEntry(id int64, reviewer User) error {
+	if !reviewer.IsAdmin {
+		return errEntryForbidden
+	}
+	return runInTx(func(u *unitOfWork) error {
+		p, err := reviewPendingEntry(u.Tx, id, reviewer, pendingStatusRejected)
+		if err != nil {
+			return err
+		}
+		// キーワードだけで spam とは限らないので、説明文だけを覚える
+		if p.Description == "" {
+			return nil
+		}
+		return spamVerdicts.Set(u, p.Description, true)
+	})
+}
+
+func moderationHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+	if !currentUser(r).IsAdmin {
+		return errModerationForbidden
+	}
+
+	entries, err := queryPendingEntries(`WHERE p.status = ? ORDER BY p.id LIMIT ?`, pendingStatusPending, moderationPerPage)
+	if err != nil {
+		return err
+	}
+
+	re.HTML(w, http.StatusOK, "moderation", struct {
+		Context context.Context
+		Entries []*PendingEntry
+	}{
+		r.Context(), entries,
+	})
+	return nil
+}
+
+func moderationReviewHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return &NotFoundError{"post not found"}
+	}
+
+	reviewer := currentUser(r)
+	switch mux.Vars(r)["action"] {
+	case "approve":
+		err = approvePendingEntry(id, reviewer)
+	case "reject":
+		err = rejectPendingEntry(id, reviewer)
+	default:
+		return &NotFoundError{}
+	}
+	switch err {
+	case nil:
+	case errEntryForbidden:
+		return errModerationForbidden
+	case sql.ErrNoRows:
+		return &NotFoundError{"post not found"}
+	default:
+		return err
+	}
+
+	http.Redirect(w, r, "/admin/moderation", http.StatusFound)
+	return nil
+}
+
+// pendingHandler はログインユーザーの承認待ちの投稿と最近の結果を表示する
+func pendingHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
+	}
+
+	entries, err := queryPendingEntries(`WHERE p.author_id = ? ORDER BY p.id DESC LIMIT ?`, currentUser(r).ID, moderationPerPage)
+	if err != nil {
+		return err
+	}
+
+	re.HTML(w, http.StatusOK, "pending", struct {
+		Context context.Context
+		Entries []*PendingEntry
+	}{
+		r.Context(), entries,
+	})
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// user.password には "<アルゴリズム名>$<ハッシュ>" の形で保存する。
+// プレフィックスのないものは以前の sha1(salt + password) の hex
+type passwordHasher interface {
+	Name() string
+	// Hash はプレフィックスを含まないハッシュを返す
+	Hash(password string) (string, error)
+	Verify(password, hash string) (bool, error)
+}
+
+var (
+	passwordHashers = map[string]passwordHasher{}
+	// 新しく保存するときに使う
+	currentPasswordHasher passwordHasher
+
+	errUnknownPasswordHasher = errors.New("unknown password hasher")
+	errMalformedPasswordHash = errors.New("malformed password hash")
+)
+
+func registerPasswordHasher(h passwordHasher) {
+	passwordHashers[h.Name()] = h
+}
+
+func init() {
+	registerPasswordHasher(bcryptHasher{cost: bcrypt.DefaultCost})
+	registerPasswordHasher(scryptHasher{n: 1 << 15, r: 8, p: 1, keyLen: 32})
+	registerPasswordHasher(argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32})
+	currentPasswordHasher = passwordHashers["bcrypt"]
+}
+
+func setCurrentPasswordHasher(name string) error {
+	h, ok := passwordHashers[name]
+	if !ok {
+		return errUnknownPasswordHasher
+	}
+	currentPasswordHasher = h
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	h, err := currentPasswordHasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	return currentPasswordHasher.Name() + "$" + h, nil
+}
+
+// verifyPassword は user のパスワードを検証する。
+// needsRehash は現在のアルゴリズム以外で保存されていることを表す
+func verifyPassword(user User, password string) (ok bool, needsRehash bool, err error) {
+	i := strings.IndexByte(user.Password, '$')
+	if i < 0 {
+		sum := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+password)))
+		ok = subtle.ConstantTimeCompare([]byte(sum), []byte(user.Password)) == 1
+		return ok, true, nil
+	}
+
+	name, hash := user.Password[:i], user.Password[i+1:]
+	h, found := passwordHashers[name]
+	if !found {
+		return false, false, errUnknownPasswordHasher
+	}
+	ok, err = h.Verify(password, hash)
+	if err != nil {
+		return false, false, err
+	}
+	return ok, name != currentPasswordHasher.Name(), nil
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+var b64 = base64.RawStdEncoding
+
+// =====================
+//		bcrypt
+// =====================
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Name() string { return "bcrypt" }
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(b), err
+}
+
+func (h bcryptHasher) Verify(password, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// =====================
+//		scrypt
+// =====================
+// N=<n>,r=<r>,p=<p>$<salt>$<key>
+
+type scryptHasher struct {
+	n, r, p, keyLen int
+}
+
+func (h scryptHasher) Name() string { return "scrypt" }
+
+func (h scryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, h.n, h.r, h.p, h.keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("N=%d,r=%d,p=%d$%s$%s", h.n, h.r, h.p, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h scryptHasher) Verify(password, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 {
+		return false, errMalformedPasswordHash
+	}
+	var n, r, p int
+	if _, err := fmt.Sscanf(parts[0], "N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return false, errMalformedPasswordHash
+	}
+	salt, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+	want, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+	got, err := scrypt.Key([]byte(password), salt, n, r, p, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// =====================
+//		argon2id
+// =====================
+// v=<version>$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+
+type argon2idHasher struct {
+	time, memory uint32
+	threads      uint8
+	keyLen       uint32
+}
+
+func (h argon2idHasher) Name() string { return "argon2id" }
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Verify(password, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 {
+		return false, errMalformedPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformedPasswordHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errMalformedPasswordHash
+	}
+	salt, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+	want, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
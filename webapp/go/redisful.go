@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	// "strconv"
 
@@ -36,6 +37,13 @@ func NewRedisful() (*Redisful, error) {
 	}, nil
 }
 
+// プールから取ったコネクションを使う。Close でプールに返る
+func NewRedisfulFromPool(pool *redis.Pool) *Redisful {
+	return &Redisful{
+		Conn: pool.Get(),
+	}
+}
+
 func (r *Redisful) Close() error {
 	return r.Conn.Close()
 }
@@ -92,6 +100,22 @@ func (r *Redisful) SetDataToCache(key string, v interface{}) error {
 	return nil
 }
 
+// ttl が過ぎると消える
+func (r *Redisful) SetDataWithExpireToCache(key string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.Conn.Do("SET", key, data, "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		if err.Error() == WrongTypeError.Error() {
+			log.Fatal(err)
+		}
+		return err
+	}
+	return nil
+}
+
 // SETNXはkeyが存在しない場合のみ挿入
 func (r *Redisful) SetNXDataToCache(key string, v interface{}) (bool, error) {
 	data, err := json.Marshal(v)
@@ -113,6 +137,20 @@ func (r *Redisful) IncrementDataInCache(key string) error {
 	return nil
 }
 
+// INCR と PEXPIRE を 1 つのスクリプトで行い、有効期限のないキーが残らないようにする
+var incrementWithExpireScript = redis.NewScript(1, `
+local n = redis.call("INCR", KEYS[1])
+if n == 1 or redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// キーがなければ ttl をつけて作る。INCR 後の値を返す
+func (r *Redisful) IncrementDataWithExpireInCache(key string, ttl time.Duration) (int64, error) {
+	return redis.Int64(incrementWithExpireScript.Do(r.Conn, key, int64(ttl/time.Millisecond)))
+}
+
 func (r *Redisful) DecrementDataInCache(key string) error {
 	_, err := r.Conn.Do("DECR", key)
 	if err != nil {
@@ -343,6 +381,31 @@ func (r *Redisful) PushSetToCache(key string, v interface{}) error {
 	return nil
 }
 
+// まとめて SADD する
+func (r *Redisful) PushSetMembersToCache(key string, vs ...interface{}) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(vs)+1)
+	args = append(args, key)
+	for _, v := range vs {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		args = append(args, data)
+	}
+
+	_, err := r.Conn.Do("SADD", args...)
+	if err != nil {
+		if err.Error() == WrongTypeError.Error() {
+			log.Fatal(err)
+		}
+		return err
+	}
+	return nil
+}
+
 // マッチするものを1つ削除
 func (r *Redisful) RemoveSetFromCache(key string, v interface{}) error {
 	data, err := json.Marshal(v)
@@ -467,6 +530,42 @@ func (r *Redisful) GetSortedSetRankRangeWithLimitFromCache(key string, min, max,
 	return data, nil
 }
 
+func (r *Redisful) RemoveKeyFromCache(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	_, err := r.Conn.Do("DEL", args...)
+	return err
+}
+
+// KEYS の代わりに SCAN で pattern にマッチするキーを全部集める
+func (r *Redisful) ScanKeysInCache(pattern string) ([]string, error) {
+	var keys []string
+	cursor := 0
+	for {
+		res, err := redis.Values(r.Conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, err = redis.Int(res[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		page, err := redis.Strings(res[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
 func (r *Redisful) GetTypeInCache(key string) (string, error) {
 	t, err := redis.String(r.Conn.Do("TYPE", key))
 	if err != nil {
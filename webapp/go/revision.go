@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// =====================
+//	説明文の履歴
+// =====================
+
+const revisionColumns = "r.id, r.keyword, r.description, r.author_id, IFNULL(u.name, ''), r.created_at"
+
+func scanRevision(row rowScanner) (Revision, error) {
+	rev := Revision{}
+	err := row.Scan(&rev.ID, &rev.Keyword, &rev.Description, &rev.AuthorID, &rev.AuthorName, &rev.CreatedAt)
+	return rev, err
+}
+
+func insertRevision(tx *sql.Tx, authorID int, keyword, description string) error {
+	_, err := tx.Exec(`
+		INSERT INTO entry_revision (keyword, description, author_id, created_at)
+		VALUES (?, ?, ?, NOW())
+	`, keyword, description, authorID)
+	return err
+}
+
+// resetRevisions は履歴を今のエントリだけにする
+func resetRevisions() error {
+	if _, err := db.Exec(`TRUNCATE entry_revision`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO entry_revision (keyword, description, author_id, created_at)
+		SELECT keyword, description, author_id, updated_at FROM entry ORDER BY id
+	`)
+	return err
+}
+
+// getRevisions は新しい順に返す。説明文は含めない
+func getRevisions(keyword string) ([]*Revision, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.keyword, '', r.author_id, IFNULL(u.name, ''), r.created_at
+		FROM entry_revision r LEFT JOIN user u ON u.id = r.author_id
+		WHERE r.keyword = ?
+		ORDER BY r.id DESC
+	`, keyword)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*Revision, 0)
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &rev)
+	}
+	return revisions, rows.Err()
+}
+
+func getRevision(keyword string, id int64) (Revision, error) {
+	return scanRevision(db.QueryRow(`
+		SELECT `+revisionColumns+`
+		FROM entry_revision r LEFT JOIN user u ON u.id = r.author_id
+		WHERE r.keyword = ? AND r.id = ?
+	`, keyword, id))
+}
+
+func revisionFromRequest(r *http.Request) (Revision, error) {
+	vars := mux.Vars(r)
+	keyword, _ := url.QueryUnescape(vars["keyword"])
+	id, err := strconv.ParseInt(vars["revision"], 10, 64)
+	if err != nil {
+		return Revision{}, sql.ErrNoRows
+	}
+	return getRevision(keyword, id)
+}
+
+func keywordHistoryHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+
+	keyword, _ := url.QueryUnescape(mux.Vars(r)["keyword"])
+	revisions, err := getRevisions(keyword)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return &NotFoundError{"keyword not found"}
+	}
+
+	re.HTML(w, http.StatusOK, "history", struct {
+		Context   context.Context
+		Keyword   string
+		Revisions []*Revision
+	}{
+		r.Context(), keyword, revisions,
+	})
+	return nil
+}
+
+func keywordRevisionHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+
+	rev, err := revisionFromRequest(r)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"revision not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	// 古い版はキャッシュせずにその場でリンクをつける
+	rev.Html, _ = htmlify(rev.Description)
+
+	re.HTML(w, http.StatusOK, "revision", struct {
+		Context  context.Context
+		Revision Revision
+	}{
+		r.Context(), rev,
+	})
+	return nil
+}
+
+// keywordRevertHandler は古い版の説明文で新しい版を作る
+func keywordRevertHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := requireLogin(w, r); err != nil {
+		return err
+	}
+
+	rev, err := revisionFromRequest(r)
+	if err == sql.ErrNoRows {
+		return &NotFoundError{"revision not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = postEntry(currentUser(r), rev.Keyword, rev.Description)
+	if err == errEntryForbidden {
+		return &ForbiddenError{"Only the author or an administrator can revert this keyword."}
+	}
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/keyword/"+pathURIEscape(rev.Keyword), http.StatusFound)
+	return nil
+}
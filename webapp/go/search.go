@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// =====================
+//	全文検索
+// =====================
+// キーワードと説明文を 1-gram と 2-gram で転置インデックスにする。
+// n-gram で候補を絞ってから本文と突き合わせるので、分かち書きなしで日本語も探せる
+
+const (
+	searchInTitle uint8 = 1 << iota
+	searchInDescription
+)
+
+const (
+	// タイトルに含まれていればどれだけ説明文に出てきても上にする
+	searchTitleScore      = 1 << 20
+	searchExactTitleScore = 1 << 21
+	searchSnippetRunes    = 60
+	searchDefaultPerPage  = 20
+	searchMaxPerPage      = 100
+)
+
+type searchDoc struct {
+	keyword     string
+	description string
+	// 正規化した文字列。正規化は 1 文字ずつなので元の文字列と位置がそろう
+	title []rune
+	desc  []rune
+}
+
+type searchIndex struct {
+	mu       sync.RWMutex
+	docs     map[string]*searchDoc
+	postings map[string]map[*searchDoc]uint8
+}
+
+// SearchSegment はスニペットの一部。Match ならハイライトする
+type SearchSegment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+type SearchResult struct {
+	Keyword string          `json:"keyword"`
+	Score   int             `json:"score"`
+	Snippet []SearchSegment `json:"snippet"`
+}
+
+var searchIdx = newSearchIndex()
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     map[string]*searchDoc{},
+		postings: map[string]map[*searchDoc]uint8{},
+	}
+}
+
+// normalizeRune は大文字小文字と全角英数字の違いを無視するためのもの
+func normalizeRune(r rune) rune {
+	if r >= '！' && r <= '～' {
+		r -= '！' - '!'
+	} else if r == '　' {
+		r = ' '
+	}
+	return unicode.ToLower(r)
+}
+
+func normalizeRunes(s string) []rune {
+	rs := []rune(s)
+	for i, r := range rs {
+		rs[i] = normalizeRune(r)
+	}
+	return rs
+}
+
+// eachGram は空白を含まない 1-gram と 2-gram を列挙する
+func eachGram(rs []rune, fn func(gram string)) {
+	for i, r := range rs {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		fn(string(r))
+		if i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			fn(string(rs[i : i+2]))
+		}
+	}
+}
+
+// queryGrams は語の候補を絞るのに使う n-gram。2 文字以上なら 2-gram だけで十分
+func queryGrams(term []rune) []string {
+	if len(term) == 1 {
+		return []string{string(term)}
+	}
+	grams := make([]string, 0, len(term)-1)
+	for i := 0; i+1 < len(term); i++ {
+		grams = append(grams, string(term[i:i+2]))
+	}
+	return grams
+}
+
+func indexRunes(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		j := 0
+		for j < len(sub) && s[i+j] == sub[j] {
+			j++
+		}
+		if j == len(sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+func countRunes(s, sub []rune) int {
+	n := 0
+	for i := 0; i+len(sub) <= len(s); {
+		k := indexRunes(s[i:], sub)
+		if k < 0 {
+			break
+		}
+		n++
+		i += k + len(sub)
+	}
+	return n
+}
+
+func (idx *searchIndex) addPostings(doc *searchDoc) {
+	add := func(flag uint8) func(string) {
+		return func(gram string) {
+			p, ok := idx.postings[gram]
+			if !ok {
+				p = map[*searchDoc]uint8{}
+				idx.postings[gram] = p
+			}
+			p[doc] |= flag
+		}
+	}
+	eachGram(doc.title, add(searchInTitle))
+	eachGram(doc.desc, add(searchInDescription))
+}
+
+func (idx *searchIndex) removePostings(doc *searchDoc) {
+	remove := func(gram string) {
+		if p, ok := idx.postings[gram]; ok {
+			delete(p, doc)
+			if len(p) == 0 {
+				delete(idx.postings, gram)
+			}
+		}
+	}
+	eachGram(doc.title, remove)
+	eachGram(doc.desc, remove)
+}
+
+// Put はエントリを追加するか置き換える
+func (idx *searchIndex) Put(keyword, description string) {
+	doc := &searchDoc{
+		keyword:     keyword,
+		description: description,
+		title:       normalizeRunes(keyword),
+		desc:        normalizeRunes(description),
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.docs[keyword]; ok {
+		idx.removePostings(old)
+	}
+	idx.docs[keyword] = doc
+	idx.addPostings(doc)
+}
+
+func (idx *searchIndex) Remove(keyword string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.docs[keyword]; ok {
+		idx.removePostings(old)
+		delete(idx.docs, keyword)
+	}
+}
+
+// Reset はインデックスを作り直す。作っている間も古いインデックスで検索できる
+func (idx *searchIndex) Reset(entries map[string]string) {
+	fresh := newSearchIndex()
+	for keyword, description := range entries {
+		fresh.Put(keyword, description)
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.docs, idx.postings = fresh.docs, fresh.postings
+}
+
+func searchTerms(q string) [][]rune {
+	var terms [][]rune
+	for _, f := range strings.Fields(string(normalizeRunes(q))) {
+		terms = append(terms, []rune(f))
+	}
+	return terms
+}
+
+// candidates は term の n-gram をすべて含む文書を返す
+func (idx *searchIndex) candidates(term []rune) map[*searchDoc]uint8 {
+	grams := queryGrams(term)
+	sets := make([]map[*searchDoc]uint8, 0, len(grams))
+	for _, g := range grams {
+		p, ok := idx.postings[g]
+		if !ok {
+			return nil
+		}
+		sets = append(sets, p)
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	found := make(map[*searchDoc]uint8, len(sets[0]))
+	for doc, flag := range sets[0] {
+		for _, s := range sets[1:] {
+			f, ok := s[doc]
+			if !ok {
+				flag = 0
+				break
+			}
+			flag &= f
+		}
+		if flag != 0 {
+			found[doc] = flag
+		}
+	}
+	return found
+}
+
+// Search はすべての語を含むエントリをスコアの高い順に返す。total は全件数
+func (idx *searchIndex) Search(q string, limit, offset int) ([]*SearchResult, int) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return []*SearchResult{}, 0
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var docs map[*searchDoc]int
+	for _, term := range terms {
+		cands := idx.candidates(term)
+		matched := make(map[*searchDoc]int, len(cands))
+		for doc := range cands {
+			if docs != nil {
+				if _, ok := docs[doc]; !ok {
+					continue
+				}
+			}
+			// n-gram が揃っていても並びが違うことがあるので本文で確かめる
+			score := 0
+			if indexRunes(doc.title, term) >= 0 {
+				score += searchTitleScore
+				if len(doc.title) == len(term) {
+					score += searchExactTitleScore
+				}
+			}
+			score += countRunes(doc.desc, term)
+			if score == 0 {
+				continue
+			}
+			matched[doc] = docs[doc] + score
+		}
+		docs = matched
+		if len(docs) == 0 {
+			break
+		}
+	}
+
+	ranked := make([]*searchDoc, 0, len(docs))
+	for doc := range docs {
+		ranked = append(ranked, doc)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if docs[a] != docs[b] {
+			return docs[a] > docs[b]
+		}
+		return keywordLess(a.keyword, b.keyword)
+	})
+
+	total := len(ranked)
+	if offset < 0 || offset >= total {
+		return []*SearchResult{}, total
+	}
+	ranked = ranked[offset:]
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	results := make([]*SearchResult, 0, len(ranked))
+	for _, doc := range ranked {
+		results = append(results, &SearchResult{
+			Keyword: doc.keyword,
+			Score:   docs[doc],
+			Snippet: snippet(doc, terms),
+		})
+	}
+	return results, total
+}
+
+// snippet は説明文で最初に語が出てくるあたりを切り出し、語の部分に印をつける
+func snippet(doc *searchDoc, terms [][]rune) []SearchSegment {
+	if len(doc.desc) == 0 {
+		return []SearchSegment{}
+	}
+	first := -1
+	for _, term := range terms {
+		if i := indexRunes(doc.desc, term); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	start := 0
+	if first > searchSnippetRunes/3 {
+		start = first - searchSnippetRunes/3
+	}
+	end := start + searchSnippetRunes
+	if end > len(doc.desc) {
+		end = len(doc.desc)
+	}
+
+	orig := []rune(doc.description)
+	match := make([]bool, end-start)
+	for _, term := range terms {
+		for i := start; i < end; i++ {
+			if i+len(term) <= len(doc.desc) && indexRunes(doc.desc[i:i+len(term)], term) == 0 {
+				for j := i; j < i+len(term) && j < end; j++ {
+					match[j-start] = true
+				}
+			}
+		}
+	}
+
+	var segs []SearchSegment
+	if start > 0 {
+		segs = append(segs, SearchSegment{Text: "…"})
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && match[j-start] == match[i-start] {
+			j++
+		}
+		segs = append(segs, SearchSegment{Text: string(orig[i:j]), Match: match[i-start]})
+		i = j
+	}
+	if end < len(orig) {
+		segs = append(segs, SearchSegment{Text: "…"})
+	}
+	return segs
+}
+
+func initSearchIndex() error {
+	rows, err := db.Query(`SELECT keyword, description FROM entry`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	entries := make(map[string]string)
+	for rows.Next() {
+		var keyword, description string
+		if err := rows.Scan(&keyword, &description); err != nil {
+			return err
+		}
+		entries[keyword] = description
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	searchIdx.Reset(entries)
+	return nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := setName(w, r); err != nil {
+		return err
+	}
+
+	q := r.URL.Query().Get("q")
+	page, perPage, err := parsePaging(r, searchDefaultPerPage, searchMaxPerPage)
+	if err != nil {
+		return err
+	}
+	results, total := searchIdx.Search(q, perPage, perPage*(page-1))
+	lastPage := (total + perPage - 1) / perPage
+
+	re.HTML(w, http.StatusOK, "search", struct {
+		Context  context.Context
+		Query    string
+		Results  []*SearchResult
+		Total    int
+		Page     int
+		LastPage int
+	}{
+		r.Context(), q, results, total, page, lastPage,
+	})
+	return nil
+}
+
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		return &ValidationError{"q is required"}
+	}
+	page, perPage, err := parsePaging(r, apiDefaultPerPage, searchMaxPerPage)
+	if err != nil {
+		return err
+	}
+	results, total := searchIdx.Search(q, perPage, perPage*(page-1))
+	re.JSON(w, http.StatusOK, map[string]interface{}{
+		"results":  results,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// セッションの設定は環境変数から読む
+//
+//	ISUDA_SESSION_KEYS     "<hash key>[:<block key>],..." 先頭の鍵で署名 (と暗号化) し、残りは検証だけに使う。
+//	                       未設定なら起動ごとに鍵を作るので、再起動するとログインし直しになる
+//	ISUDA_SESSION_STORE    cookie (デフォルト) か redis
+//	ISUDA_SESSION_MAX_AGE  セッションの有効期間 (time.ParseDuration の形式)
+//	ISUDA_SESSION_SECURE   true なら Secure 属性をつける
+//	ISUDA_SESSION_SAMESITE lax (デフォルト), strict, none
+
+const (
+	sessionKeyPrefix     = "SESSION-"
+	userSessionKeyPrefix = "USER-SESSIONS-"
+
+	defaultSessionMaxAge = 30 * 24 * time.Hour
+)
+
+// sessionRevoker はサーバー側でセッションを無効にできるストア
+type sessionRevoker interface {
+	RevokeUserSessions(userID int) error
+}
+
+// sessionRenewer はサーバー側のセッション ID を振り直せるストア
+type sessionRenewer interface {
+	RenewSession(session *sessions.Session) error
+}
+
+// renewSession はログイン前のセッションを捨てて空のセッションを返す。
+// ログイン前のセッション ID や CSRF トークンを知っている人にログイン後のセッションを使わせない
+func renewSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, error) {
+	session := getSession(w, r)
+	if rn, ok := store.(sessionRenewer); ok {
+		if err := rn.RenewSession(session); err != nil {
+			return nil, err
+		}
+	}
+	session.Values = make(map[interface{}]interface{})
+	return session, nil
+}
+
+func parseSessionKeys(v string) ([][]byte, error) {
+	var keyPairs [][]byte
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keys := strings.SplitN(pair, ":", 2)
+		if keys[0] == "" {
+			return nil, errors.New("empty hash key")
+		}
+		var blockKey []byte
+		if len(keys) == 2 {
+			blockKey = []byte(keys[1])
+			if l := len(blockKey); l != 16 && l != 24 && l != 32 {
+				return nil, errors.New("block key must be 16, 24 or 32 bytes")
+			}
+		}
+		keyPairs = append(keyPairs, []byte(keys[0]), blockKey)
+	}
+	if len(keyPairs) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keyPairs, nil
+}
+
+func sessionOptionsFromEnv() (*sessions.Options, error) {
+	opts := &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(defaultSessionMaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if v := os.Getenv("ISUDA_SESSION_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ISUDA_SESSION_MAX_AGE: %q", v)
+		}
+		opts.MaxAge = int(d / time.Second)
+	}
+	if v := os.Getenv("ISUDA_SESSION_SECURE"); v != "" {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISUDA_SESSION_SECURE: %q", v)
+		}
+		opts.Secure = secure
+	}
+	switch v := strings.ToLower(os.Getenv("ISUDA_SESSION_SAMESITE")); v {
+	case "", "lax":
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		opts.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid ISUDA_SESSION_SAMESITE: %q", v)
+	}
+	return opts, nil
+}
+
+// newSessionStoreFromEnv はセッションのストアと、同じ鍵で署名するログイン前の CSRF トークンのクッキーを作る
+func newSessionStoreFromEnv() (sessions.Store, *csrfCookieStore, error) {
+	var keyPairs [][]byte
+	if keys := os.Getenv("ISUDA_SESSION_KEYS"); keys != "" {
+		var err error
+		keyPairs, err = parseSessionKeys(keys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid ISUDA_SESSION_KEYS: %s", err)
+		}
+	} else {
+		// 公開されている固定の鍵を使うとクッキーを偽造できるので、その場で作る
+		log.Println("ISUDA_SESSION_KEYS is not set. Using a random session key; sessions will not survive a restart.")
+		keyPairs = [][]byte{securecookie.GenerateRandomKey(64), nil}
+	}
+	opts, err := sessionOptionsFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	csrfCookies := newCSRFCookieStore(opts, keyPairs...)
+
+	switch v := os.Getenv("ISUDA_SESSION_STORE"); v {
+	case "", "cookie":
+		s := sessions.NewCookieStore(keyPairs...)
+		s.Options = opts
+		s.MaxAge(opts.MaxAge)
+		return s, csrfCookies, nil
+	case "redis":
+		return newRedisSessionStore(redisPool, opts, keyPairs...), csrfCookies, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid ISUDA_SESSION_STORE: %q", v)
+	}
+}
+
+// =========================
+//	Redis セッションストア
+// =========================
+// クッキーには署名したセッション ID だけを入れ、値は SESSION-<id> に gob で保存する。
+// ログイン中のセッションは USER-SESSIONS-<user_id> にまとめて、まとめて無効にできるようにする
+
+type redisSessionStore struct {
+	pool    *redis.Pool
+	codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newRedisSessionStore(pool *redis.Pool, opts *sessions.Options, keyPairs ...[]byte) *redisSessionStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(opts.MaxAge)
+		}
+	}
+	return &redisSessionStore{
+		pool:    pool,
+		codecs:  codecs,
+		Options: opts,
+	}
+}
+
+func (s *redisSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *redisSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...); err != nil {
+		return session, err
+	}
+	found, err := s.load(session)
+	if err != nil {
+		return session, err
+	}
+	if !found {
+		// 失効済み
+		session.ID = ""
+		return session, nil
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *redisSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if err := s.erase(session); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *redisSessionStore) load(session *sessions.Session) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", sessionKeyPrefix+session.ID))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values)
+}
+
+func (s *redisSessionStore) save(session *sessions.Session) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = int(defaultSessionMaxAge / time.Second)
+	}
+	if _, err := conn.Do("SETEX", sessionKeyPrefix+session.ID, maxAge, buf.Bytes()); err != nil {
+		return err
+	}
+	if userID, ok := session.Values["user_id"]; ok {
+		key := fmt.Sprintf("%s%v", userSessionKeyPrefix, userID)
+		if _, err := conn.Do("SADD", key, session.ID); err != nil {
+			return err
+		}
+		if _, err := conn.Do("EXPIRE", key, maxAge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisSessionStore) erase(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if userID, ok := session.Values["user_id"]; ok {
+		if _, err := conn.Do("SREM", fmt.Sprintf("%s%v", userSessionKeyPrefix, userID), session.ID); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("DEL", sessionKeyPrefix+session.ID)
+	return err
+}
+
+// RenewSession は古いセッションを消し、次の Save で新しい ID を振る
+func (s *redisSessionStore) RenewSession(session *sessions.Session) error {
+	if err := s.erase(session); err != nil {
+		return err
+	}
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+func (s *redisSessionStore) RevokeUserSessions(userID int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s%d", userSessionKeyPrefix, userID)
+	ids, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		return err
+	}
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, key)
+	for _, id := range ids {
+		args = append(args, sessionKeyPrefix+id)
+	}
+	_, err = conn.Do("DEL", args...)
+	return err
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =====================
+//	スパム判定
+// =====================
+// スパム判定の設定は環境変数から読む
+//
+//	ISUDA_SPAM_BACKEND       isupam (デフォルト)、local (NG ワードだけ)、chain (NG ワードのあと isupam)
+//	ISUDA_NG_WORDS           local と chain で使う NG ワードのファイル (例: ng_words.txt)
+//	ISUPAM_ORIGIN            isupam の URL
+//	ISUPAM_TIMEOUT           1 回のリクエストのタイムアウト (デフォルト 1s)
+//	ISUPAM_RETRIES           失敗したときに再試行する回数 (デフォルト 2)
+//	ISUPAM_BREAKER_THRESHOLD 続けて何回失敗したら isupam を呼ぶのをやめるか (デフォルト 5)
+//	ISUPAM_BREAKER_COOLDOWN  やめてから次に試すまでの時間 (デフォルト 10s)
+//	ISUPAM_FAILURE_POLICY    isupam が使えないとき closed (デフォルト) なら投稿を断り、open なら通す
+
+// SpamChecker は判定できなかったときにエラーを返す
+type SpamChecker interface {
+	IsSpam(content string) (bool, error)
+}
+
+var (
+	spamChecker SpamChecker
+
+	errSpamCheckerUnavailable = errors.New("spam checker is unavailable")
+	errCircuitOpen            = errors.New("circuit breaker is open")
+)
+
+// =====================
+//	サーキットブレーカー
+// =====================
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// half-open で試しているリクエストがあるか
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow はリクエストしてよいかを返す。half-open のときは 1 つだけ通す
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = circuitClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			log.Printf("isupam: circuit opened after %d failures", b.failures)
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// =====================
+//	isupam
+// =====================
+
+type isupamChecker struct {
+	endpoint string
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	breaker  *circuitBreaker
+}
+
+// isupamStatusError は isupam が 200 以外を返したときのエラー
+type isupamStatusError struct {
+	code int
+}
+
+func (e *isupamStatusError) Error() string {
+	return fmt.Sprintf("isupam returned %d", e.code)
+}
+
+func newIsupamCheckerFromEnv(endpoint string) (*isupamChecker, error) {
+	c := &isupamChecker{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Second},
+		retries:  2,
+		backoff:  50 * time.Millisecond,
+	}
+	threshold, cooldown := 5, 10*time.Second
+
+	if v := os.Getenv("ISUPAM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ISUPAM_TIMEOUT: %q", v)
+		}
+		c.client.Timeout = d
+	}
+	if v := os.Getenv("ISUPAM_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid ISUPAM_RETRIES: %q", v)
+		}
+		c.retries = n
+	}
+	if v := os.Getenv("ISUPAM_BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid ISUPAM_BREAKER_THRESHOLD: %q", v)
+		}
+		threshold = n
+	}
+	if v := os.Getenv("ISUPAM_BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ISUPAM_BREAKER_COOLDOWN: %q", v)
+		}
+		cooldown = d
+	}
+	c.breaker = newCircuitBreaker(threshold, cooldown)
+	return c, nil
+}
+
+// newSpamCheckerFromEnv は設定にしたがって SpamChecker を組み立てる。
+// NG ワードを使う場合はそのフィルタも返す
+func newSpamCheckerFromEnv(isupamEndpoint string) (SpamChecker, *localSpamFilter, error) {
+	failOpen, err := spamFailOpenFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := os.Getenv("ISUDA_SPAM_BACKEND")
+	var filter *localSpamFilter
+	switch backend {
+	case "", "isupam":
+	case "local", "chain":
+		path := os.Getenv("ISUDA_NG_WORDS")
+		if path == "" {
+			return nil, nil, fmt.Errorf("ISUDA_NG_WORDS is required for the %s backend", backend)
+		}
+		filter, err = newLocalSpamFilter(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if backend == "local" {
+			return spamFailurePolicy{next: filter, failOpen: failOpen}, filter, nil
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid ISUDA_SPAM_BACKEND: %q", backend)
+	}
+
+	isupam, err := newIsupamCheckerFromEnv(isupamEndpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	// NG ワードは読み直すと判定が変わるので、キャッシュするのは isupam の判定だけ
+	cached, err := newCachedSpamCheckerFromEnv(isupam)
+	if err != nil {
+		return nil, nil, err
+	}
+	var checker SpamChecker = cached
+	if filter != nil {
+		checker = spamChain{filter, cached}
+	}
+	return spamFailurePolicy{next: checker, failOpen: failOpen}, filter, nil
+}
+
+func spamFailOpenFromEnv() (bool, error) {
+	switch v := strings.ToLower(os.Getenv("ISUPAM_FAILURE_POLICY")); v {
+	case "", "closed":
+		return false, nil
+	case "open":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid ISUPAM_FAILURE_POLICY: %q", v)
+	}
+}
+
+// spamFailurePolicy は判定できなかったときの扱いを決める。
+// fail-open なら spam ではないとし、fail-closed なら errSpamCheckerUnavailable を返す
+type spamFailurePolicy struct {
+	next     SpamChecker
+	failOpen bool
+}
+
+func (p spamFailurePolicy) IsSpam(content string) (bool, error) {
+	spam, err := p.next.IsSpam(content)
+	if err == nil {
+		return spam, nil
+	}
+	log.Printf("spam checker: %s", err)
+	spamCheckErrors.Add(1)
+	if p.failOpen {
+		return false, nil
+	}
+	return false, errSpamCheckerUnavailable
+}
+
+// IsSpam は isupam に問い合わせる。失敗したら再試行し、続けて失敗したらしばらく問い合わせない
+func (c *isupamChecker) IsSpam(content string) (bool, error) {
+	if !c.breaker.Allow() {
+		return false, errCircuitOpen
+	}
+
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			time.Sleep(c.backoff << uint(i-1))
+		}
+		var spam bool
+		spam, err = c.post(content)
+		if err == nil {
+			c.breaker.Success()
+			return spam, nil
+		}
+		// 4xx は何度送っても同じなので再試行しない
+		if se, ok := err.(*isupamStatusError); ok && se.code < 500 {
+			break
+		}
+	}
+	c.breaker.Failure()
+	return false, err
+}
+
+func (c *isupamChecker) post(content string) (bool, error) {
+	v := url.Values{}
+	v.Set("content", content)
+	resp, err := c.client.PostForm(c.endpoint, v)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, &isupamStatusError{resp.StatusCode}
+	}
+
+	var data struct {
+		Valid *bool `json:"valid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return false, err
+	}
+	if data.Valid == nil {
+		return false, errors.New("isupam response has no valid field")
+	}
+	return !*data.Valid, nil
+}
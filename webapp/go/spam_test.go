@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestIsupamChecker(endpoint string, retries int, timeout time.Duration) *isupamChecker {
+	return &isupamChecker{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: timeout},
+		retries:  retries,
+		backoff:  time.Millisecond,
+		breaker:  newCircuitBreaker(3, time.Hour),
+	}
+}
+
+// startFakeIsupam は fakeisupam をビルドして起動し、その URL と止める関数を返す
+func startFakeIsupam(t *testing.T, args ...string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fakeisupam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "fakeisupam")
+	if out, err := exec.Command("go", "build", "-o", bin, "./fakeisupam").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("cannot build fakeisupam: %s\n%s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(bin, append([]string{"-addr", addr}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	endpoint := "http://" + addr
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(endpoint); err == nil {
+			resp.Body.Close()
+			return endpoint, stop
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stop()
+	t.Fatal("fakeisupam did not start")
+	return "", nil
+}
+
+func TestIsupamCheckerWithFakeIsupam(t *testing.T) {
+	endpoint, stop := startFakeIsupam(t)
+	defer stop()
+	c := newTestIsupamChecker(endpoint, 0, time.Second)
+	for content, want := range map[string]bool{
+		"hello":        false,
+		"buy spam now": true,
+		"スパムではない":      true,
+	} {
+		spam, err := c.IsSpam(content)
+		if err != nil {
+			t.Fatalf("IsSpam(%q): %s", content, err)
+		}
+		if spam != want {
+			t.Errorf("IsSpam(%q) = %v, want %v", content, spam, want)
+		}
+	}
+}
+
+func TestIsupamCheckerWithFakeIsupamDown(t *testing.T) {
+	endpoint, stop := startFakeIsupam(t, "-down")
+	defer stop()
+	c := newTestIsupamChecker(endpoint, 1, time.Second)
+	for i := 0; i < 3; i++ {
+		_, err := c.IsSpam("hello")
+		if se, ok := err.(*isupamStatusError); !ok || se.code != http.StatusServiceUnavailable {
+			t.Fatalf("attempt %d: got %v, want a 503 status error", i, err)
+		}
+	}
+	// 3 回続けて失敗したのでもう問い合わせない
+	if _, err := c.IsSpam("hello"); err != errCircuitOpen {
+		t.Fatalf("got %v, want errCircuitOpen", err)
+	}
+}
+
+func TestIsupamCheckerRetries(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"valid":false}`))
+	}))
+	defer ts.Close()
+
+	c := newTestIsupamChecker(ts.URL, 2, time.Second)
+	spam, err := c.IsSpam("hello")
+	if err != nil || !spam {
+		t.Fatalf("got %v, %v, want spam after retries", spam, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+}
+
+func TestIsupamCheckerDoesNotRetryClientErrors(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	c := newTestIsupamChecker(ts.URL, 2, time.Second)
+	if _, err := c.IsSpam("hello"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
+
+func TestIsupamCheckerTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"valid":true}`))
+	}))
+	defer ts.Close()
+
+	c := newTestIsupamChecker(ts.URL, 0, 20*time.Millisecond)
+	start := time.Now()
+	if _, err := c.IsSpam("hello"); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("took %s, the timeout was not applied", d)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := newCircuitBreaker(2, 30*time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("closed breaker should allow")
+	}
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("breaker opened before the threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("breaker should be open after the threshold")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("half-open breaker should allow one probe")
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker should allow only one probe")
+	}
+	// 試しに失敗したらすぐに open に戻る
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("failed probe should reopen the breaker")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("half-open breaker should allow one probe")
+	}
+	b.Success()
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatal("successful probe should close the breaker")
+		}
+	}
+}
+
+type failingSpamChecker struct{}
+
+func (failingSpamChecker) IsSpam(string) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+func TestSpamFailurePolicy(t *testing.T) {
+	spam, err := spamFailurePolicy{next: failingSpamChecker{}, failOpen: true}.IsSpam("hello")
+	if spam || err != nil {
+		t.Errorf("fail-open: got %v, %v, want not spam", spam, err)
+	}
+	_, err = spamFailurePolicy{next: failingSpamChecker{}}.IsSpam("hello")
+	if err != errSpamCheckerUnavailable {
+		t.Errorf("fail-closed: got %v, want errSpamCheckerUnavailable", err)
+	}
+}
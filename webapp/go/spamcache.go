@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// =====================
+//	スパム判定のキャッシュ
+// =====================
+// 判定結果を SPAM-<content の sha256> に保存する。spam と判定されたものは長めに、
+// spam でないものは短めに持つ。TTL は環境変数で変えられ、0 ならキャッシュしない
+//
+//	ISUDA_SPAM_CACHE_SPAM_TTL spam の判定を持つ時間 (デフォルト 24h)
+//	ISUDA_SPAM_CACHE_HAM_TTL  spam でない判定を持つ時間 (デフォルト 1h)
+//	ISUDA_DEBUG_ADDR          /debug/vars を待ち受けるアドレス (デフォルト 127.0.0.1:6060)。off なら出さない
+//
+// 件数は ISUDA_DEBUG_ADDR の /debug/vars で見られる
+
+const spamCacheKeyPrefix = "SPAM-"
+
+var (
+	spamCacheHits   = expvar.NewInt("spam_cache_hits")
+	spamCacheMisses = expvar.NewInt("spam_cache_misses")
+	spamCheckErrors = expvar.NewInt("spam_check_errors")
+)
+
+type cachedSpamChecker struct {
+	next    SpamChecker
+	spamTTL time.Duration
+	hamTTL  time.Duration
+}
+
+func newCachedSpamCheckerFromEnv(next SpamChecker) (*cachedSpamChecker, error) {
+	c := &cachedSpamChecker{
+		next:    next,
+		spamTTL: 24 * time.Hour,
+		hamTTL:  time.Hour,
+	}
+	for _, e := range []struct {
+		name string
+		ttl  *time.Duration
+	}{
+		{"ISUDA_SPAM_CACHE_SPAM_TTL", &c.spamTTL},
+		{"ISUDA_SPAM_CACHE_HAM_TTL", &c.hamTTL},
+	} {
+		if v := os.Getenv(e.name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s: %q", e.name, v)
+			}
+			*e.ttl = d
+		}
+	}
+	return c, nil
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func spamCacheKey(content string) string {
+	return spamCacheKeyPrefix + contentHash(content)
+}
+
+// IsSpam はキャッシュになければ next に問い合わせる。Redis のエラーではキャッシュを使わないだけにする
+func (c *cachedSpamChecker) IsSpam(content string) (bool, error) {
+	key := spamCacheKey(content)
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	var spam bool
+	err := r.GetDataFromCache(key, &spam)
+	if err == nil {
+		spamCacheHits.Add(1)
+		return spam, nil
+	}
+	if err != redis.ErrNil {
+		log.Printf("spam cache: %s", err)
+	}
+	spamCacheMisses.Add(1)
+
+	spam, err = c.next.IsSpam(content)
+	if err != nil {
+		return false, err
+	}
+	ttl := c.hamTTL
+	if spam {
+		ttl = c.spamTTL
+	}
+	if ttl > 0 {
+		if err := r.SetDataWithExpireToCache(key, spam, ttl); err != nil {
+			log.Printf("spam cache: %s", err)
+		}
+	}
+	return spam, nil
+}
+
+// isSpamContents は contents を並行して判定し、どれか 1 つでも spam なら true を返す。
+// spam が見つかれば、ほかの判定に失敗していても spam とする
+func isSpamContents(contents ...string) (bool, error) {
+	uniq := make(map[string]struct{}, len(contents))
+	for _, c := range contents {
+		uniq[c] = struct{}{}
+	}
+
+	type verdict struct {
+		spam bool
+		err  error
+	}
+	results := make(chan verdict, len(uniq))
+	var wg sync.WaitGroup
+	for c := range uniq {
+		wg.Add(1)
+		go func(content string) {
+			defer wg.Done()
+			spam, err := spamChecker.IsSpam(content)
+			results <- verdict{spam, err}
+		}(c)
+	}
+	wg.Wait()
+	close(results)
+
+	var firstErr error
+	for v := range results {
+		if v.spam {
+			return true, nil
+		}
+		if v.err != nil && firstErr == nil {
+			firstErr = v.err
+		}
+	}
+	return false, firstErr
+}
+
+// startDebugServer は /debug/vars を addr で別に待ち受ける。
+// アプリは nginx の後ろにいて RemoteAddr がいつもループバックなので、同じポートでは出さない
+func startDebugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("debug server on %s stopped: %s", addr, err)
+		}
+	}()
+}
@@ -2,103 +2,336 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
-
-	_ "github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// var (
-// 	baseUrl *url.URL
-// 	db      *sql.DB
-// 	re      *render.Render
-// )
+const (
+	// STARS-<keyword> に Star を id 順に JSON で積む
+	starsKeyPrefix = "STARS-"
+	// STAR-RATE-<user>-<keyword> に期間内にスターした回数を持つ
+	starRateKeyPrefix = "STAR-RATE-"
+
+	starColumns = "id, keyword, user_name, created_at"
+
+	// スターのつけ方の制限
+	starPolicyUnique    = "unique"    // 1 ユーザー 1 キーワードにつき 1 つまで
+	starPolicyRateLimit = "ratelimit" // 1 ユーザー 1 キーワードにつき starRateWindow の間に starRateLimit 回まで
+	starPolicyNone      = "none"
+
+	mysqlErrDupEntry = 1062
+)
 
 var (
-	starCache []Star
+	starPolicy     = starPolicyUnique
+	starRateLimit  = 10
+	starRateWindow = time.Minute
 )
 
 func initializeStar() error {
 	_, err := db.Exec("TRUNCATE star")
-	return err
+	if err != nil {
+		return err
+	}
+	return warmStarStore()
 }
 
-func loadStarsFromCache(keyword string) []*Star {
-	var stars []*Star
-	for _, s := range starCache {
-		if s.Keyword == keyword {
-			stars = append(stars, &s)
+// warmStarStore は MySQL の star を Redis に載せ直す
+func warmStarStore() error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	keys, err := r.ScanKeysInCache(starsKeyPrefix + "*")
+	if err != nil {
+		return err
+	}
+	if err := r.RemoveKeyFromCache(keys...); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT ` + starColumns + ` FROM star ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := Star{}
+		if err := rows.Scan(&s.ID, &s.Keyword, &s.UserName, &s.CreatedAt); err != nil {
+			return err
+		}
+		if err := r.RPushListToCache(starsKeyPrefix+s.Keyword, s); err != nil {
+			return err
 		}
 	}
-	return stars
+	return rows.Err()
 }
 
-func loadStars(keyword string) []*Star {
-	// v := url.Values{}
-	// v.Set("keyword", keyword)
+// reloadStarsOfKeyword は keyword のスターだけ MySQL から載せ直す
+func reloadStarsOfKeyword(keyword string) error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
 
-	rows, err := db.Query(`SELECT * FROM star WHERE keyword = ?`, keyword)
-	if err != nil && err != sql.ErrNoRows {
-		panicIf(err)
-		return nil
+	rows, err := db.Query(`SELECT `+starColumns+` FROM star WHERE keyword = ? ORDER BY id`, keyword)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stars := make([]Star, 0, 10)
+	for rows.Next() {
+		s := Star{}
+		if err := rows.Scan(&s.ID, &s.Keyword, &s.UserName, &s.CreatedAt); err != nil {
+			return err
+		}
+		stars = append(stars, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	stars := make([]*Star, 0, 10)
+	if err := r.RemoveKeyFromCache(starsKeyPrefix + keyword); err != nil {
+		return err
+	}
+	for _, s := range stars {
+		if err := r.RPushListToCache(starsKeyPrefix+keyword, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushStarToStore(s Star) error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+	return r.RPushListToCache(starsKeyPrefix+s.Keyword, s)
+}
+
+func loadStars(keyword string) ([]*Star, error) {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	data, err := r.GetListFromCache(starsKeyPrefix + keyword)
+	if err != nil {
+		return nil, err
+	}
+	stars := make([]*Star, 0, len(data))
+	for _, d := range data {
+		s := &Star{}
+		if err := json.Unmarshal(d, s); err != nil {
+			return nil, err
+		}
+		stars = append(stars, s)
+	}
+	return stars, nil
+}
+
+const (
+	starsDefaultLimit = 100
+	starsMaxLimit     = 1000
+)
+
+// parseStarTime は RFC3339 か unix 秒を受け付ける
+func parseStarTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// GET /stars?keyword=&user=&since=&until=&cursor=&limit=
+// id 順に limit (デフォルト starsDefaultLimit) 件ずつ返し、続きがあれば next_cursor を返す
+func starsHandler(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	conds := make([]string, 0, 5)
+	args := make([]interface{}, 0, 6)
+
+	if keyword := q.Get("keyword"); keyword != "" {
+		conds = append(conds, "keyword = ?")
+		args = append(args, keyword)
+	}
+	if user := q.Get("user"); user != "" {
+		conds = append(conds, "user_name = ?")
+		args = append(args, user)
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := parseStarTime(v)
+		if err != nil {
+			return &ValidationError{"invalid since"}
+		}
+		conds = append(conds, "created_at >= ?")
+		args = append(args, t)
+	}
+	if v := q.Get("until"); v != "" {
+		t, err := parseStarTime(v)
+		if err != nil {
+			return &ValidationError{"invalid until"}
+		}
+		conds = append(conds, "created_at < ?")
+		args = append(args, t)
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor < 0 {
+			return &ValidationError{"invalid cursor"}
+		}
+		conds = append(conds, "id > ?")
+		args = append(args, cursor)
+	}
+	limit := starsDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > starsMaxLimit {
+			return &ValidationError{fmt.Sprintf("limit must be between 1 and %d", starsMaxLimit)}
+		}
+		limit = n
+	}
+
+	query := "SELECT " + starColumns + " FROM star"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	// 続きがあるか知るために 1 件多く取る
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stars := make([]Star, 0, 10)
 	for rows.Next() {
 		s := Star{}
-		err := rows.Scan(&s.ID, &s.Keyword, &s.UserName, &s.CreatedAt)
-		panicIf(err)
-		stars = append(stars, &s)
+		if err := rows.Scan(&s.ID, &s.Keyword, &s.UserName, &s.CreatedAt); err != nil {
+			return err
+		}
+		stars = append(stars, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	res := map[string]interface{}{
+		"result": stars,
+	}
+	if len(stars) > limit {
+		stars = stars[:limit]
+		res["result"] = stars
+		res["next_cursor"] = stars[limit-1].ID
 	}
-	rows.Close()
-	return stars
+	re.JSON(w, http.StatusOK, res)
+	return nil
 }
 
-// func starsHandler(w http.ResponseWriter, r *http.Request) {
-// 	keyword := r.FormValue("keyword")
-// 	rows, err := db.Query(`SELECT * FROM star WHERE keyword = ?`, keyword)
-// 	if err != nil && err != sql.ErrNoRows {
-// 		panicIf(err)
-// 		return
-// 	}
-
-// 	stars := make([]Star, 0, 10)
-// 	for rows.Next() {
-// 		s := Star{}
-// 		err := rows.Scan(&s.ID, &s.Keyword, &s.UserName, &s.CreatedAt)
-// 		panicIf(err)
-// 		stars = append(stars, s)
-// 	}
-// 	rows.Close()
-
-// 	re.JSON(w, http.StatusOK, map[string][]Star{
-// 		"result": stars,
-// 	})
-// }
-
-func starsPostHandler(w http.ResponseWriter, r *http.Request) {
-	keyword := r.FormValue("keyword")
+// allowStar はレート制限の枠が残っていれば消費して true を返す
+func allowStar(user, keyword string) (bool, error) {
+	if starPolicy != starPolicyRateLimit {
+		return true, nil
+	}
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	n, err := r.IncrementDataWithExpireInCache(starRateKeyPrefix+user+"-"+keyword, starRateWindow)
+	if err != nil {
+		return false, err
+	}
+	return n <= int64(starRateLimit), nil
+}
+
+func starsPostHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := apiAuthenticate(w, r); err != nil {
+		return err
+	}
+	user := getContext(r, "user_name").(string)
 
+	keyword := r.FormValue("keyword")
 	_, err := getEntryByKeyword(keyword)
 	if err == sql.ErrNoRows {
-		notFound(w)
-		return
+		return &NotFoundError{"keyword not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	ok, err := allowStar(user, keyword)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &TooManyRequestsError{"too many stars"}
+	}
+
+	// unique のときだけ unique_star を埋めて (keyword, user_name, unique_star) の一意制約を効かせる
+	var uniqueStar interface{}
+	if starPolicy == starPolicyUnique {
+		uniqueStar = 1
+	}
+
+	now := time.Now().Truncate(time.Second)
+	err = runInTx(func(u *unitOfWork) error {
+		res, err := u.Tx.Exec(`INSERT INTO star (keyword, user_name, unique_star, created_at) VALUES (?, ?, ?, ?)`, keyword, user, uniqueStar, now)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		star := Star{ID: int(id), Keyword: keyword, UserName: user, CreatedAt: now}
+		// ロールバック後に MySQL から載せ直せば追加したスターは消える
+		return u.Do(func() error {
+			return pushStarToStore(star)
+		}, func() error {
+			return reloadStarsOfKeyword(keyword)
+		})
+	})
+	if isDuplicateEntry(err) {
+		return &ConflictError{"already starred"}
+	}
+	if err != nil {
+		return err
+	}
+	if err := updateSuggestion(keyword); err != nil {
+		return err
 	}
 
-	user := r.FormValue("user")
+	re.JSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	return nil
+}
+
+// DELETE /stars?keyword= でログインユーザーの一番新しいスターを外す
+func starsDeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := apiAuthenticate(w, r); err != nil {
+		return err
+	}
+	user := getContext(r, "user_name").(string)
 
-	tx, err := db.Begin()
-	panicIf(err)
+	keyword := r.FormValue("keyword")
+	if keyword == "" {
+		return &ValidationError{"keyword is required"}
+	}
 
-	_, err = db.Exec(`INSERT INTO star (keyword, user_name, created_at) VALUES (?, ?, NOW())`, keyword, user)
+	res, err := db.Exec(`DELETE FROM star WHERE keyword = ? AND user_name = ? ORDER BY id DESC LIMIT 1`, keyword, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
-		tx.Rollback()
-		panicIf(err)
+		return err
+	}
+	if n == 0 {
+		return &NotFoundError{"star not found"}
+	}
+	if err := reloadStarsOfKeyword(keyword); err != nil {
+		return err
 	}
-	if err = tx.Commit(); err != nil {
-		tx.Rollback()
-		panicIf(err)
+	if err := updateSuggestion(keyword); err != nil {
+		return err
 	}
-	starCache = append(starCache, Star{Keyword: keyword, UserName: user})
 
 	re.JSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	return nil
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =====================
+//	キーワードの補完
+// =====================
+// SUGGEST-<prefix> にその prefix で始まるキーワードを入れた sorted set を作る。
+// prefix は検索と同じく正規化した先頭 1〜suggestMaxPrefix 文字。
+// スコアは スター数<<32 + updated_at で、スターの多い順、同じなら新しい順に並ぶ
+
+const (
+	suggestKeyPrefix     = "SUGGEST-"
+	suggestMaxPrefix     = 20
+	suggestDefaultLimit  = 10
+	suggestMaxLimit      = 50
+	suggestScoreStarBits = 32
+	// ZADD のスコアは double なので 2^53 未満に収める
+	suggestMaxScore = 1<<53 - 1
+)
+
+func suggestPrefixes(keyword string) []string {
+	rs := normalizeRunes(keyword)
+	n := len(rs)
+	if n > suggestMaxPrefix {
+		n = suggestMaxPrefix
+	}
+	prefixes := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		prefixes = append(prefixes, string(rs[:i]))
+	}
+	return prefixes
+}
+
+func suggestScore(stars int, updatedAt time.Time) int {
+	score := stars<<suggestScoreStarBits + int(uint32(updatedAt.Unix()))
+	if score > suggestMaxScore {
+		score = suggestMaxScore
+	}
+	return score
+}
+
+func putSuggestion(r *Redisful, keyword string, score int) error {
+	for _, p := range suggestPrefixes(keyword) {
+		if _, err := r.PushSortedSetToCache(suggestKeyPrefix+p, score, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildSuggestIndex は全エントリから補完用のインデックスを作り直す
+func rebuildSuggestIndex() error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	keys, err := r.ScanKeysInCache(suggestKeyPrefix + "*")
+	if err != nil {
+		return err
+	}
+	if err := r.RemoveKeyFromCache(keys...); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`
+		SELECT e.keyword, e.updated_at, COUNT(s.id)
+		FROM entry e LEFT JOIN star s ON s.keyword = e.keyword
+		GROUP BY e.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var keyword string
+		var updatedAt time.Time
+		var stars int
+		if err := rows.Scan(&keyword, &updatedAt, &stars); err != nil {
+			return err
+		}
+		if err := putSuggestion(r, keyword, suggestScore(stars, updatedAt)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// updateSuggestion はエントリの更新やスターの増減をスコアに反映する
+func updateSuggestion(keyword string) error {
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT updated_at FROM entry WHERE keyword = ?`, keyword).Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		// エントリのないキーワードへのスターは補完に出さない
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+	stars, err := r.GetListLengthInCache(starsKeyPrefix + keyword)
+	if err != nil {
+		return err
+	}
+	return putSuggestion(r, keyword, suggestScore(int(stars), updatedAt))
+}
+
+func removeSuggestion(keyword string) error {
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+
+	for _, p := range suggestPrefixes(keyword) {
+		if err := r.RemoveSortedSetFromCache(suggestKeyPrefix+p, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suggestKeywords は prefix で始まるキーワードを limit 件まで返す
+func suggestKeywords(prefix string, limit int) ([]string, error) {
+	rs := normalizeRunes(prefix)
+	if len(rs) == 0 {
+		return []string{}, nil
+	}
+	// インデックスにない長さの prefix は先頭 suggestMaxPrefix 文字で引いてから絞る
+	long := len(rs) > suggestMaxPrefix
+	key := rs
+	count := limit
+	if long {
+		key = rs[:suggestMaxPrefix]
+		count = -1
+	}
+
+	r := NewRedisfulFromPool(redisPool)
+	defer r.Close()
+	data, err := r.GetSortedSetRankRangeWithLimitFromCache(suggestKeyPrefix+string(key), 0, suggestMaxScore, 0, count, true)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := decodeStringSet(data)
+	if err != nil {
+		return nil, err
+	}
+	if !long {
+		return keywords, nil
+	}
+
+	filtered := make([]string, 0, limit)
+	for _, kw := range keywords {
+		if strings.HasPrefix(string(normalizeRunes(kw)), string(rs)) {
+			filtered = append(filtered, kw)
+			if len(filtered) == limit {
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// GET /keywords/suggest?prefix=&limit=
+func keywordsSuggestHandler(w http.ResponseWriter, r *http.Request) error {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		return &ValidationError{"prefix is required"}
+	}
+	limit := suggestDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > suggestMaxLimit {
+			return &ValidationError{"limit must be between 1 and " + strconv.Itoa(suggestMaxLimit)}
+		}
+		limit = n
+	}
+
+	keywords, err := suggestKeywords(prefix, limit)
+	if err != nil {
+		return err
+	}
+	re.JSON(w, http.StatusOK, map[string]interface{}{
+		"keywords": keywords,
+	})
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// unitOfWork は MySQL のトランザクションと、それに合わせて行う Redis などへの副作用をまとめる
+type unitOfWork struct {
+	Tx *sql.Tx
+
+	compensations []func() error
+	afterCommit   []func() error
+}
+
+// Do は副作用 fn を実行し、成功したら取り消し用の undo を記録する。
+// トランザクションがロールバックされると記録した undo が逆順に呼ばれる
+func (u *unitOfWork) Do(fn func() error, undo func() error) error {
+	if err := fn(); err != nil {
+		return err
+	}
+	if undo != nil {
+		u.compensations = append(u.compensations, undo)
+	}
+	return nil
+}
+
+// AfterCommit はコミットに成功したあとで fn を呼ぶ。
+// fn のエラーはログに出すだけなので、失敗しても整合性が崩れない後片付けにだけ使う
+func (u *unitOfWork) AfterCommit(fn func() error) {
+	u.afterCommit = append(u.afterCommit, fn)
+}
+
+func (u *unitOfWork) compensate() {
+	for i := len(u.compensations) - 1; i >= 0; i-- {
+		if err := u.compensations[i](); err != nil {
+			log.Printf("compensation failed: %s", err)
+		}
+	}
+	u.compensations = nil
+}
+
+// runInTx は fn を 1 つのトランザクションで実行する。
+// fn がエラーを返すか panic するか、コミットに失敗した場合はロールバックして副作用を取り消す
+func runInTx(fn func(u *unitOfWork) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	u := &unitOfWork{Tx: tx}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			u.compensate()
+			panic(p)
+		}
+	}()
+
+	if err := fn(u); err != nil {
+		tx.Rollback()
+		u.compensate()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		u.compensate()
+		return err
+	}
+	for _, fn := range u.afterCommit {
+		if err := fn(); err != nil {
+			log.Printf("after commit: %s", err)
+		}
+	}
+	return nil
+}
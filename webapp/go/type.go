@@ -6,16 +6,17 @@ import (
 )
 
 type Entry struct {
-	ID            int
-	AuthorID      int
-	Keyword       string
-	Description   string
-	UpdatedAt     time.Time
-	CreatedAt     time.Time
-	KeywordLength int64
-
-	Html  string
-	Stars []*Star
+	ID            int       `json:"id"`
+	AuthorID      int       `json:"author_id"`
+	Keyword       string    `json:"keyword"`
+	Description   string    `json:"description"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	KeywordLength int64     `json:"-"`
+	Protected     bool      `json:"protected"`
+
+	Html  string  `json:"html,omitempty"`
+	Stars []*Star `json:"stars,omitempty"`
 }
 
 type User struct {
@@ -24,6 +25,7 @@ type User struct {
 	Salt      string
 	Password  string
 	CreatedAt time.Time
+	IsAdmin   bool
 }
 
 type Star struct {
@@ -33,6 +35,29 @@ type Star struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Revision は entry_revision の 1 行
+type Revision struct {
+	ID          int64
+	Keyword     string
+	Description string
+	AuthorID    int
+	AuthorName  string
+	CreatedAt   time.Time
+
+	Html string
+}
+
+// PendingEntry は spam と判定されて承認を待っている投稿
+type PendingEntry struct {
+	ID          int64
+	AuthorID    int
+	AuthorName  string
+	Keyword     string
+	Description string
+	Status      string
+	CreatedAt   time.Time
+}
+
 type EntryWithCtx struct {
 	Context context.Context
 	Entry   Entry
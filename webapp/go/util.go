@@ -1,58 +1,105 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"runtime/debug"
+	"strconv"
+	"strings"
 )
 
-func prepareHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if h := r.Header.Get("X-Forwarded-Host"); h != "" {
-			baseUrl, _ = url.Parse("http://" + h)
-		} else {
-			baseUrl, _ = url.Parse("http://" + r.Host)
+// parsePaging は page と per_page を読む。maxPerPage が 0 なら per_page は受け付けず defaultPerPage を使う。
+// offset が int に収まらないページは受け付けない
+func parsePaging(r *http.Request, defaultPerPage, maxPerPage int) (page, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+	q := r.URL.Query()
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, &ValidationError{"page must be a positive integer"}
+		}
+		page = n
+	}
+	if v := q.Get("per_page"); v != "" && maxPerPage > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			return 0, 0, &ValidationError{fmt.Sprintf("per_page must be between 1 and %d", maxPerPage)}
 		}
-		fn(w, r)
+		perPage = n
+	}
+	if page > math.MaxInt32/perPage {
+		return 0, 0, &ValidationError{"page is too large"}
 	}
+	return page, perPage, nil
 }
 
-func myHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				fmt.Fprintf(os.Stderr, "%+v", err)
-				debug.PrintStack()
-				http.Error(w, http.StatusText(500), 500)
-			}
-		}()
-		prepareHandler(fn)(w, r)
+// requestBaseURL はリクエストのスキームとホストから base URL を組み立てる。
+// canonicalOrigin が設定されていればそちらを使う
+func requestBaseURL(r *http.Request) *url.URL {
+	if canonicalOrigin != nil {
+		return canonicalOrigin
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		p = strings.ToLower(strings.TrimSpace(strings.Split(p, ",")[0]))
+		if p == "http" || p == "https" {
+			scheme = p
+		}
 	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = strings.TrimSpace(strings.Split(h, ",")[0])
+	}
+	return &url.URL{Scheme: scheme, Host: host}
 }
 
-func pathURIEscape(s string) string {
-	return (&url.URL{Path: s}).String()
+func getBaseURL(ctx context.Context) *url.URL {
+	if u, ok := ctx.Value("base_url").(*url.URL); ok {
+		return u
+	}
+	if canonicalOrigin != nil {
+		return canonicalOrigin
+	}
+	return &url.URL{}
 }
 
-func notFound(w http.ResponseWriter) {
-	code := http.StatusNotFound
-	http.Error(w, http.StatusText(code), code)
+// handlerFunc はエラーを返すハンドラ。エラーは writeError で応答にする
+type handlerFunc func(http.ResponseWriter, *http.Request) error
+
+func prepareHandler(fn handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		setContext(r, "base_url", requestBaseURL(r))
+		return fn(w, r)
+	}
 }
 
-func badRequest(w http.ResponseWriter) {
-	code := http.StatusBadRequest
-	http.Error(w, http.StatusText(code), code)
+// serveHandler は fn を http.HandlerFunc にする。エラーは preferJSON を既定にして Accept で形式を選ぶ
+func serveHandler(fn handlerFunc, preferJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 取りこぼした panic も接続を切らずに 500 として返す
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("panic: %v\n%s", v, debug.Stack())
+				writeError(w, r, fmt.Errorf("panic: %v", v), preferJSON)
+			}
+		}()
+		if err := prepareHandler(csrfProtect(fn))(w, r); err != nil {
+			writeError(w, r, err, preferJSON)
+		}
+	}
 }
 
-func forbidden(w http.ResponseWriter) {
-	code := http.StatusForbidden
-	http.Error(w, http.StatusText(code), code)
+func myHandler(fn handlerFunc) http.HandlerFunc {
+	return serveHandler(fn, false)
 }
 
-func panicIf(err error) {
-	if err != nil {
-		panic(err)
-	}
+func pathURIEscape(s string) string {
+	return (&url.URL{Path: s}).String()
 }
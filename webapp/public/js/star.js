@@ -8,11 +8,16 @@ $('.js-add-star').on('click', function() {
     }
     $.post('/stars', {
         keyword: keyword,
-        user: userName
+        csrf_token: $('meta[name="csrf-token"]').attr('content')
     }).done(function() {
         $('.js-stars').filter(function() {
             return this.getAttribute('data-keyword') == keyword;
         }).trigger('addStar');
+    }).fail(function(xhr) {
+        var res = xhr.responseJSON;
+        if (res && res.error) {
+            alert(res.error.message);
+        }
     });
 });
 
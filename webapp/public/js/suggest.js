@@ -0,0 +1,59 @@
+// キーワード欄と説明文の入力中の語から既存のキーワードを補完する
+(function() {
+    var timer = null;
+
+    function fetchSuggestions(prefix, done) {
+        if (!prefix) {
+            return;
+        }
+        $.getJSON('/keywords/suggest', { prefix: prefix }).done(function(res) {
+            done(res.keywords || []);
+        });
+    }
+
+    // カーソルの直前にある空白を含まない語
+    function currentWord(textarea) {
+        var before = textarea.value.slice(0, textarea.selectionStart);
+        var m = before.match(/[^\s]+$/);
+        return m ? m[0] : '';
+    }
+
+    $('input.js-suggest').on('input', function() {
+        var input = this;
+        clearTimeout(timer);
+        timer = setTimeout(function() {
+            fetchSuggestions(input.value, function(keywords) {
+                var list = $('#' + input.getAttribute('list')).empty();
+                keywords.forEach(function(kw) {
+                    list.append($('<option>').attr('value', kw));
+                });
+            });
+        }, 200);
+    });
+
+    $('textarea.js-suggest').on('input', function() {
+        var textarea = this;
+        var list = $(textarea).closest('form').find('.js-suggestions');
+        clearTimeout(timer);
+        timer = setTimeout(function() {
+            var word = currentWord(textarea);
+            if (!word) {
+                list.empty();
+                return;
+            }
+            fetchSuggestions(word, function(keywords) {
+                list.empty();
+                keywords.forEach(function(kw) {
+                    $('<li>').text(kw).on('click', function() {
+                        var pos = textarea.selectionStart;
+                        var before = textarea.value.slice(0, pos - word.length);
+                        textarea.value = before + kw + textarea.value.slice(pos);
+                        textarea.selectionStart = textarea.selectionEnd = before.length + kw.length;
+                        textarea.focus();
+                        list.empty();
+                    }).appendTo(list);
+                });
+            });
+        }, 200);
+    });
+})();